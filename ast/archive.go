@@ -0,0 +1,115 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// archiveSep separates the path of an archive from the path of a file in it.
+const archiveSep = "!/"
+
+// archiveExts are the extensions of the archives that files can be read from.
+var archiveExts = []string{".zip", ".tar", ".tar.gz", ".tgz"}
+
+// splitArchive splits name of the form archive!/file into its parts.
+// If name is not of this form, or the archive does not have one of the
+// archiveExts, it returns name and the empty string.
+func splitArchive(name string) (archive, file string) {
+	// The separator may have been converted by filepath.FromSlash.
+	slashed := filepath.ToSlash(name)
+	i := strings.Index(slashed, archiveSep)
+	if i < 0 {
+		return name, ""
+	}
+	archive, file = name[:i], path.Clean(slashed[i+len(archiveSep):])
+	for _, ext := range archiveExts {
+		if strings.HasSuffix(strings.ToLower(archive), ext) {
+			return archive, file
+		}
+	}
+	return name, ""
+}
+
+// ReadFile reads the file name like ioutil.ReadFile, except that a file
+// in a zip or tar archive can be read without extracting it, by giving
+// name in the form archive!/file, for example
+//
+//  templates.zip!/partials/head.html
+//
+// Tar archives may be compressed with gzip. If the archive does not contain
+// the file, the error satisfies os.IsNotExist.
+func ReadFile(name string) ([]byte, error) {
+	archive, file := splitArchive(name)
+	if file == "" {
+		return ioutil.ReadFile(name)
+	}
+	if strings.HasSuffix(strings.ToLower(archive), ".zip") {
+		return readZip(archive, file)
+	}
+	return readTar(archive, file)
+}
+
+func readZip(archive, file string) ([]byte, error) {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if path.Clean(f.Name) != file {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(rc)
+	}
+	return nil, notInArchive(archive, file)
+}
+
+func readTar(archive, file string) ([]byte, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if !strings.HasSuffix(strings.ToLower(archive), ".tar") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, notInArchive(archive, file)
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg && path.Clean(hdr.Name) == file {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
+
+func notInArchive(archive, file string) error {
+	return &os.PathError{Op: "open", Path: archive + archiveSep + file, Err: os.ErrNotExist}
+}
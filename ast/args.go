@@ -0,0 +1,181 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/goulash/lex"
+)
+
+// The ArgType data type describes the type of a command argument.
+type ArgType int
+
+const (
+	IdentArg  ArgType = iota // IdentArg is a bare word, such as or
+	StringArg                // StringArg is a quoted string
+	NumberArg                // NumberArg is an integer or decimal number
+	BoolArg                  // BoolArg is true or false
+)
+
+func (t ArgType) String() string {
+	switch t {
+	case IdentArg:
+		return "identifier"
+	case StringArg:
+		return "string"
+	case NumberArg:
+		return "number"
+	case BoolArg:
+		return "bool"
+	default:
+		return "unknown"
+	}
+}
+
+// An Arg is a single argument to a command. Arguments are either positional,
+// or they are given as key=value pairs, in which case Key is set.
+type Arg struct {
+	Type  ArgType
+	Key   string
+	Value string
+}
+
+// String returns the argument as it could be written in a command.
+func (a Arg) String() string {
+	v := a.Value
+	if a.Type == StringArg {
+		v = strconv.Quote(v)
+	}
+	if a.Key != "" {
+		return a.Key + "=" + v
+	}
+	return v
+}
+
+// Bool returns the value of a BoolArg.
+func (a Arg) Bool() (bool, error) {
+	if a.Type != BoolArg {
+		return false, a.typeError(BoolArg)
+	}
+	return a.Value == "true", nil
+}
+
+// Int returns the value of a NumberArg that is an integer.
+func (a Arg) Int() (int, error) {
+	if a.Type != NumberArg {
+		return 0, a.typeError(NumberArg)
+	}
+	return strconv.Atoi(a.Value)
+}
+
+// Float returns the value of a NumberArg.
+func (a Arg) Float() (float64, error) {
+	if a.Type != NumberArg {
+		return 0, a.typeError(NumberArg)
+	}
+	return strconv.ParseFloat(a.Value, 64)
+}
+
+func (a Arg) typeError(t ArgType) error {
+	return fmt.Errorf("argument %s is a %s, expecting a %s", a, a.Type, t)
+}
+
+// A Command is a command as it was parsed, with the typed arguments it was
+// given, which is passed to Parser.OnCommand before the command is run.
+type Command struct {
+	PosInfo
+
+	// Name is the name of the command after aliases are resolved, such as
+	// include, include?, or require.
+	Name string
+
+	// Args are the arguments, in order. Those of pragma begin with the name
+	// of the pragma as an IdentArg.
+	Args []Arg
+}
+
+// String returns the command as it could be written, without the trigger.
+func (c Command) String() string {
+	s := c.Name
+	for _, a := range c.Args {
+		s += " " + a.String()
+	}
+	return s
+}
+
+// onCommand passes the command cmd at pi with the arguments args to
+// OnCommand, if it is set, and counts it in Metrics.
+func (p *Parser) onCommand(pi PosInfo, cmd string, args []Arg) {
+	if p.Metrics != nil {
+		p.Metrics.add(cmd, pi.Name)
+	}
+	if p.OnCommand != nil {
+		p.OnCommand(Command{PosInfo: pi, Name: cmd, Args: args})
+	}
+}
+
+// parseArgs reads all arguments of a command up to and including the end
+// of the action. If an error occurs, the end of the action is not read.
+func (p *Parser) parseArgs(r *lex.Reader) ([]Arg, error) {
+	var args []Arg
+	for {
+		tok := r.Next()
+		if tok.Type == typeActionEnd {
+			return args, nil
+		}
+		if tok.Type == typeIdent && r.Peek().Type == typeEquals {
+			r.Next()
+			if r.Peek().Type == typeActionEnd {
+				return nil, fmt.Errorf("argument %s has no value", tok.Value)
+			}
+			a, err := p.argOf(r.Next())
+			if err != nil {
+				return nil, err
+			}
+			if a.Type == IdentArg {
+				return nil, fmt.Errorf("value of argument %s must be a string, number, or bool", tok.Value)
+			}
+			a.Key = tok.Value
+			args = append(args, a)
+			continue
+		}
+		a, err := p.argOf(tok)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+	}
+}
+
+// argOf converts a single token into an argument.
+func (p *Parser) argOf(tok lex.Token) (Arg, error) {
+	// The value is copied, since arguments end up in errors and macros that
+	// may outlive the source, which can be a mapped file (see Parser.Mmap).
+	tok.Value = string([]byte(tok.Value))
+	switch tok.Type {
+	case typeString, typeLongString:
+		v, err := p.stringValue(tok)
+		if err != nil {
+			return Arg{}, err
+		}
+		return Arg{Type: StringArg, Value: v}, nil
+	case typeNumber:
+		return Arg{Type: NumberArg, Value: tok.Value}, nil
+	case typeIdent:
+		if tok.Value == "true" || tok.Value == "false" {
+			return Arg{Type: BoolArg, Value: tok.Value}, nil
+		}
+		return Arg{Type: IdentArg, Value: tok.Value}, nil
+	case lex.TypeError:
+		return Arg{}, errors.New(tok.Value)
+	case lex.TypeEOF:
+		return Arg{}, errors.New("unexpected EOF")
+	default:
+		return Arg{}, fmt.Errorf("unexpected %s in arguments", TokenType(tok.Type))
+	}
+}
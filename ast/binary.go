@@ -0,0 +1,66 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// ErrBinary is returned for files that are binary, unless their policy is
+// BinaryPassthrough.
+var ErrBinary = errors.New("file is binary")
+
+// A BinaryPolicy decides what happens to binary files, which are files that
+// contain NUL bytes. Files that are merely not valid UTF-8, such as those in
+// Latin-1, are text; use StrictUTF8 to reject them.
+type BinaryPolicy int
+
+const (
+	// BinaryError makes reading a binary file an error, ErrBinary.
+	BinaryError BinaryPolicy = iota
+
+	// BinaryPassthrough outputs binary files as they are, without looking
+	// for commands or comments in them.
+	BinaryPassthrough
+)
+
+// ErrInvalidUTF8 is returned for files that are not valid UTF-8 if
+// StrictUTF8 is true, with the position of the first invalid byte.
+var ErrInvalidUTF8 = errors.New("invalid UTF-8")
+
+// checkUTF8 returns an error at the position of the first byte of code that
+// is not valid UTF-8 in the file name, if there is one.
+func (p *Parser) checkUTF8(name, code string) error {
+	if utf8.ValidString(code) {
+		return nil
+	}
+	off := 0
+	for off < len(code) {
+		r, w := utf8.DecodeRuneInString(code[off:])
+		if r == utf8.RuneError && w == 1 {
+			break
+		}
+		off += w
+	}
+	ix := indexLines(code)
+	line := ix.lineAt(off)
+	col := off - ix.offset(line) + 1
+	if p.TabWidth > 0 {
+		col = visualColumn(ix.line(code, line), col, p.TabWidth)
+	}
+	return &Error{
+		Err:     fmt.Errorf("%w: byte 0x%02x", ErrInvalidUTF8, code[off]),
+		PosInfo: PosInfo{p.DisplayName(name), line, col},
+	}
+}
+
+// isBinary returns true if bs is the content of a binary file, which no
+// text file contains a NUL byte in.
+func isBinary(bs []byte) bool {
+	return bytes.IndexByte(bs, 0) >= 0
+}
@@ -12,6 +12,36 @@ type Commenter struct {
 
 	// If Strip is true, the comment is stripped out of the text.
 	Strip bool
+
+	// If Expand is true, builtins and symbols are replaced inside the
+	// comment when it is kept, as they are in the text. Commands are still
+	// not recognized inside it.
+	Expand bool
+
+	// If ColumnOne is true, Begin only begins a comment in the first column
+	// of a line, as the C of Fortran does. Elsewhere it is text.
+	ColumnOne bool
+
+	// If Directive is not empty, a comment whose text begins with it,
+	// after any spaces, is a directive instead of a comment. For example,
+	// with the Directive "pre:", the comment
+	//
+	//  /* pre:include "x" */
+	//
+	// includes the file x, so that directives can be hidden from tools that
+	// do not know pre. The directive must end on the line the comment
+	// begins on, and a newline directly after the comment is removed.
+	Directive string
+}
+
+// directiveAt returns true if s begins with a comment of c that is
+// a directive.
+func (c *Commenter) directiveAt(s string) bool {
+	if c.Directive == "" || !c.IsComment(s) {
+		return false
+	}
+	s = strings.TrimLeft(s[len(c.Begin):], " \t")
+	return strings.HasPrefix(s, c.Directive)
 }
 
 func (c *Commenter) IsComment(s string) bool {
@@ -29,6 +59,17 @@ func (cs Commenters) IsComment(s string) bool {
 	return false
 }
 
+// FirstAt returns the first commenter that s begins a comment of, given
+// whether s is at the beginning of a line, or nil if there is none.
+func (cs Commenters) FirstAt(s string, lineStart bool) *Commenter {
+	for _, c := range cs {
+		if c.IsComment(s) && (lineStart || !c.ColumnOne) {
+			return c
+		}
+	}
+	return nil
+}
+
 func (cs Commenters) First(s string) *Commenter {
 	for _, c := range cs {
 		if c.IsComment(s) {
@@ -0,0 +1,221 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/goulash/lex"
+)
+
+// builtins are replaced in the text if Builtins is true, and
+// platformBuiltins if PlatformBuiltins is true.
+var (
+	builtins         = []string{"__FILE__", "__LINE__", "__EXT__", "__BASENAME__"}
+	platformBuiltins = []string{"__GOOS__", "__GOARCH__", "__HOSTNAME__", "__USER__"}
+	allBuiltins      = append(append([]string(nil), builtins...), platformBuiltins...)
+)
+
+// builtinNames returns the names of the builtins that are replaced.
+func (p *Parser) builtinNames() []string {
+	switch {
+	case p.Builtins && p.platform():
+		return allBuiltins
+	case p.Builtins:
+		return builtins
+	case p.platform():
+		return platformBuiltins
+	}
+	return nil
+}
+
+// platform returns true if the platformBuiltins are replaced, which they
+// never are in SafeMode, since they reveal the machine.
+func (p *Parser) platform() bool {
+	return p.PlatformBuiltins && !p.SafeMode
+}
+
+// builtinAt returns the name of the builtin or symbol that the lexer is at,
+// or the empty string. Both are only recognized as entire identifiers.
+func (p *Parser) builtinAt(l *lex.Lexer) string {
+	names := p.builtinNames()
+	if len(names) == 0 && len(p.Symbols) == 0 || isIdent(prevRune(l)) {
+		return ""
+	}
+	if len(names) > 0 && l.HasPrefix("__") {
+		for _, b := range names {
+			if identAt(l, b) {
+				return b
+			}
+		}
+	}
+	for name := range p.Symbols {
+		if identAt(l, name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// identAt returns true if the lexer is at the entire identifier name.
+func identAt(l *lex.Lexer, name string) bool {
+	if !l.HasPrefix(name) {
+		return false
+	}
+	r, _ := utf8.DecodeRuneInString(l.Input(len(name)))
+	return !isIdent(r)
+}
+
+// prevRune returns the rune before the current position of the lexer,
+// or utf8.RuneError if there is none.
+func prevRune(l *lex.Lexer) rune {
+	n := l.Pos()
+	if n > utf8.UTFMax {
+		n = utf8.UTFMax
+	}
+	r, _ := utf8.DecodeLastRuneInString(l.Input(-n)[:n])
+	return r
+}
+
+func (p *Parser) parseBuiltin(r *lex.Reader) (parseFn, error) {
+	t := r.Next()
+	pi := p.posInfo(r)
+	s, err := p.builtin(t.Value, pi)
+	if err != nil {
+		return nil, err
+	}
+	p.record(t.Pos, t.Value, FateReplaced)
+	if !p.headerText(s, t.Value, pi) {
+		p.addNode(&TextNode{pi, s, t.Value})
+	}
+	return p.parseNext, nil
+}
+
+// builtin returns the value of the builtin or symbol name at pi.
+func (p *Parser) builtin(name string, pi PosInfo) (string, error) {
+	switch name {
+	case "__FILE__":
+		return strconv.Quote(pi.Name), nil
+	case "__LINE__":
+		return strconv.Itoa(pi.Line), nil
+	case "__EXT__":
+		return strings.TrimPrefix(filepath.Ext(p.rootName()), "."), nil
+	case "__BASENAME__":
+		return filepath.Base(p.rootName()), nil
+	case "__GOOS__":
+		return runtime.GOOS, nil
+	case "__GOARCH__":
+		return runtime.GOARCH, nil
+	case "__HOSTNAME__":
+		host, _ := os.Hostname()
+		return host, nil
+	case "__USER__":
+		return userName(), nil
+	}
+	v, ok := p.Symbols[name]
+	if !ok {
+		return "", fmt.Errorf("unknown builtin %s", name)
+	}
+	return v, nil
+}
+
+// expandComment replaces the builtins and symbols in the comment s at pi,
+// in the same way as they are replaced in the text.
+func (p *Parser) expandComment(s string, pi PosInfo) string {
+	var b strings.Builder
+	prev := utf8.RuneError
+	for i := 0; i < len(s); {
+		if !isIdent(prev) {
+			if name := p.nameAt(s[i:]); name != "" {
+				pi := pi
+				if n := strings.Count(s[:i], "\n"); n > 0 {
+					pi.Line += n
+					pi.Column = i - strings.LastIndexByte(s[:i], '\n')
+				} else {
+					pi.Column += i
+				}
+				v, _ := p.builtin(name, pi)
+				b.WriteString(v)
+				i += len(name)
+				prev, _ = utf8.DecodeLastRuneInString(name)
+				continue
+			}
+		}
+		r, n := utf8.DecodeRuneInString(s[i:])
+		b.WriteString(s[i : i+n])
+		prev = r
+		i += n
+	}
+	return b.String()
+}
+
+// nameAt returns the builtin or symbol that s begins with as an entire
+// identifier, or the empty string.
+func (p *Parser) nameAt(s string) string {
+	at := func(name string) bool {
+		if !strings.HasPrefix(s, name) {
+			return false
+		}
+		r, _ := utf8.DecodeRuneInString(s[len(name):])
+		return !isIdent(r)
+	}
+	for _, b := range p.builtinNames() {
+		if at(b) {
+			return b
+		}
+	}
+	for name := range p.Symbols {
+		if at(name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// userName returns the name of the user running the parser, or the empty
+// string if it is not known.
+func userName() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return os.Getenv("USERNAME")
+}
+
+// rootName returns the name of the root file, as it was given to Parse
+// or ParseString.
+func (p *Parser) rootName() string {
+	fn := p.nod
+	for fn.root != nil {
+		fn = fn.root
+	}
+	return fn.name
+}
+
+// parseSystemInclude includes a file given in the form <file>, which is
+// searched for in the IncludePaths.
+func (p *Parser) parseSystemInclude(r *lex.Reader, unique bool) (parseFn, error) {
+	pi := p.posInfo(r)
+	args, ok := r.Expect(typeRaw, typeActionEnd)
+	if !ok {
+		return nil, expectError(args, "expecting a single argument of the form <file>")
+	}
+
+	name := args[0].Value[1 : len(args[0].Value)-1]
+	var inc includeArgs
+	for _, dir := range p.IncludePaths {
+		inc.paths = append(inc.paths, includePath(dir, name))
+	}
+	return p.parseNext, p.parseFirst(&inc, pi, unique)
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import (
+	"fmt"
+	"io"
+	"log"
+)
+
+// A Diagnostic reports a condition that does not stop parsing, but that
+// may be of interest, such as a path that could not be resolved.
+type Diagnostic struct {
+	PosInfo
+	Code    string // identifies the kind of condition, such as "redefined-macro"
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s", d.PosInfo, d.Message)
+}
+
+// A DiagnosticsSink receives diagnostics as they occur.
+type DiagnosticsSink interface {
+	Diagnose(d Diagnostic)
+}
+
+// DiagnosticsFunc is a function that is a DiagnosticsSink.
+type DiagnosticsFunc func(d Diagnostic)
+
+func (f DiagnosticsFunc) Diagnose(d Diagnostic) { f(d) }
+
+// WriterSink returns a sink that writes each diagnostic to w on a line of
+// its own, prefixed by "warning: ".
+func WriterSink(w io.Writer) DiagnosticsSink {
+	return DiagnosticsFunc(func(d Diagnostic) {
+		fmt.Fprintf(w, "warning: %s\n", d)
+	})
+}
+
+// LoggerSink returns a sink that prints each diagnostic to l.
+func LoggerSink(l *log.Logger) DiagnosticsSink {
+	return DiagnosticsFunc(func(d Diagnostic) {
+		l.Print(d)
+	})
+}
+
+// Diagnostics returns all diagnostics that occurred while parsing,
+// in order. If Sink is set, diagnostics are passed to it instead, and
+// Diagnostics returns nothing.
+func (p *Parser) Diagnostics() []Diagnostic {
+	return p.diags
+}
+
+func (p *Parser) diagnose(pi PosInfo, code, format string, args ...interface{}) {
+	d := Diagnostic{pi, code, fmt.Sprintf(format, args...)}
+	if p.Sink != nil {
+		p.Sink.Diagnose(d)
+		return
+	}
+	p.diags = append(p.diags, d)
+}
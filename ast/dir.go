@@ -0,0 +1,105 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrIsDir is the error for including a directory, unless IncludeDirs
+// is true.
+var ErrIsDir = errors.New("cannot include a directory")
+
+// A DirFileSystem is a FileSystem that can also list directories, which
+// is needed to include directories with Parser.IncludeDirs.
+type DirFileSystem interface {
+	FileSystem
+
+	// ReadDir returns the sorted names of the files in the directory name,
+	// without those of its subdirectories. If name is not a directory, an
+	// error is returned.
+	ReadDir(name string) ([]string, error)
+}
+
+// ReadDir implements DirFileSystem.
+func (fs MapFS) ReadDir(name string) ([]string, error) {
+	abs, _ := fs.Abs(name)
+	prefix := abs + string(filepath.Separator)
+	if abs == string(filepath.Separator) {
+		prefix = abs
+	}
+	var names []string
+	found := false
+	for path := range fs {
+		rest := strings.TrimPrefix(path, prefix)
+		if rest == path {
+			continue
+		}
+		found = true
+		if !strings.ContainsRune(rest, filepath.Separator) {
+			names = append(names, rest)
+		}
+	}
+	if !found {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// readDir returns the sorted names of the files in the directory name, or
+// an error if name is not a directory or cannot be listed.
+func (p *Parser) readDir(name string) ([]string, error) {
+	if isAngled(name) {
+		return nil, errors.New("fragments are not directories")
+	}
+	if p.FS != nil {
+		dfs, ok := p.FS.(DirFileSystem)
+		if !ok {
+			return nil, errors.New("file system cannot list directories")
+		}
+		return dfs.ReadDir(name)
+	}
+	if _, file := splitArchive(name); file != "" {
+		return nil, errors.New("directories in archives cannot be listed")
+	}
+	fis, err := ioutil.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+// parseDir includes the files names in the directory dir in order, as
+// parseFile would each of them, if IncludeDirs is true. Otherwise, and
+// always for the root file, it fails with ErrIsDir.
+func (p *Parser) parseDir(dir string, names []string, pi PosInfo, unique bool, sum, via string) error {
+	if !p.IncludeDirs || p.nod == nil {
+		return fmt.Errorf("%s: %w", dir, ErrIsDir)
+	}
+	if sum != "" {
+		return fmt.Errorf("%s: the checksum of a directory cannot be checked", dir)
+	}
+	p.dirs = append(p.dirs, resolveIn(p.fs(), dir))
+	for _, name := range names {
+		err := p.parseFile(filepath.Join(dir, name), pi, unique, "", via)
+		if err != nil && err != errRequireIgnore {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import "path/filepath"
+
+// A Fate is what became of a position in the source of a file in the
+// output, as returned by FileNode.Fate.
+type Fate int
+
+const (
+	FateUnknown  Fate = iota // FateUnknown is for positions not in the tree
+	FateEmitted              // FateEmitted is for source that is output as it is
+	FateReplaced             // FateReplaced is for builtins and symbols, which are replaced
+	FateStripped             // FateStripped is for comments that are stripped
+	FateRemoved              // FateRemoved is for directives and other removed source
+)
+
+func (f Fate) String() string {
+	switch f {
+	case FateEmitted:
+		return "emitted"
+	case FateReplaced:
+		return "replaced"
+	case FateStripped:
+		return "stripped"
+	case FateRemoved:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
+// span is a range of byte offsets in the source of a file, and its fate.
+type span struct {
+	start, end int
+	fate       Fate
+}
+
+// Fate returns what became of the position at line and col in the source
+// of the file name in the output of fn, where col is a byte column, as
+// when TabWidth is zero. The file is found by its name or resolved path.
+// If it occurs several times in the tree, its first occurrence counts.
+// Positions outside of the file are FateUnknown, as are all positions if
+// the tree was parsed without Fates.
+func (fn *FileNode) Fate(name string, line, col int) Fate {
+	f := fn.find(name)
+	if f == nil || !f.fates {
+		return FateUnknown
+	}
+	off := f.lines.offset(line)
+	if off < 0 || col < 1 || off+col-1 >= len(f.src) {
+		return FateUnknown
+	}
+	if col-1 > len(f.lines.line(f.src, line)) {
+		return FateUnknown
+	}
+	off += col - 1
+	for _, s := range f.spans {
+		if s.start <= off && off < s.end {
+			return s.fate
+		}
+	}
+	return FateRemoved
+}
+
+// find returns the first file in fn, including fn, with the given name
+// or resolved path, or nil.
+func (fn *FileNode) find(name string) *FileNode {
+	if fn.name == name || fn.path == name || filepath.Clean(fn.name) == filepath.Clean(name) ||
+		fn.path != "" && fn.path == resolve(name) {
+		return fn
+	}
+	for _, n := range fn.nodes {
+		if n.Type() == FileType {
+			if f := n.(*FileNode).find(name); f != nil {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+// record records the fate of the source of the token at off with
+// value s in the current file.
+func (p *Parser) record(off int, s string, fate Fate) {
+	if s != "" && p.Fates && !p.Validate {
+		p.nod.spans = append(p.nod.spans, span{off, off + len(s), fate})
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import (
+	"os"
+	"strings"
+)
+
+// isAngled returns true if name is of the form <name>. In a string, this
+// refers to a fragment in Parser.Fragments instead of to a file, and in
+// #include <name>, to a file in the IncludePaths.
+func isAngled(name string) bool {
+	return len(name) > 2 && strings.HasPrefix(name, "<") && strings.HasSuffix(name, ">")
+}
+
+// readFragment returns the content of the fragment name, which is of the
+// form <name>. If there is no such fragment, the error satisfies
+// os.IsNotExist, so that optional includes and alternatives work as they
+// do for files.
+func (p *Parser) readFragment(name string) ([]byte, string, error) {
+	code, ok := p.Fragments[name[1:len(name)-1]]
+	if !ok {
+		return nil, "", &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return []byte(code), code, nil
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// A FileSystem is what the parser reads files and resolves their paths
+// through. Setting Parser.FS to a FileSystem that does not use the
+// operating system, such as MapFS, allows the parser to run where there
+// is none, such as in a browser with GOOS=js.
+type FileSystem interface {
+	// ReadFile returns the content of the file name. If the file does not
+	// exist, the error must satisfy os.IsNotExist.
+	ReadFile(name string) ([]byte, error)
+
+	// Abs returns an absolute path for name, like filepath.Abs.
+	Abs(name string) (string, error)
+
+	// EvalSymlinks returns path with symbolic links evaluated, like
+	// filepath.EvalSymlinks.
+	EvalSymlinks(path string) (string, error)
+}
+
+// OSFileSystem is the FileSystem of the operating system, which the parser
+// uses if Parser.FS is nil. Files can also be read from archives, as with
+// ReadFile.
+type OSFileSystem struct{}
+
+func (OSFileSystem) ReadFile(name string) ([]byte, error)     { return ReadFile(name) }
+func (OSFileSystem) Abs(name string) (string, error)          { return filepath.Abs(name) }
+func (OSFileSystem) EvalSymlinks(path string) (string, error) { return filepath.EvalSymlinks(path) }
+
+// MapFS is a FileSystem in memory, which maps the absolute paths of files
+// to their content. Relative paths are relative to the root directory, and
+// there are no symbolic links.
+type MapFS map[string]string
+
+func (fs MapFS) ReadFile(name string) ([]byte, error) {
+	abs, _ := fs.Abs(name)
+	s, ok := fs[abs]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return []byte(s), nil
+}
+
+func (fs MapFS) Abs(name string) (string, error) {
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(string(filepath.Separator), name)
+	}
+	return filepath.Clean(name), nil
+}
+
+func (fs MapFS) EvalSymlinks(path string) (string, error) { return path, nil }
+
+// fs returns the FileSystem of the parser.
+func (p *Parser) fs() FileSystem {
+	if p.FS == nil {
+		return OSFileSystem{}
+	}
+	return p.FS
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// A Graph is the graph of files and the include and require commands
+// between them. A single Graph can be shared by several parsers.
+type Graph struct {
+	// Files are the paths of all files in the graph, in the order in which
+	// they were first read. Files that were not read from the file system,
+	// such as the root of ParseString, are identified by their name.
+	Files []string `json:"files"`
+
+	// Edges are the include and require commands between the Files,
+	// in the order in which they were parsed.
+	Edges []Edge `json:"edges"`
+
+	seen map[string]bool
+}
+
+// An Edge is a single include or require command.
+type Edge struct {
+	From string  `json:"from"`
+	To   string  `json:"to"`
+	Kind string  `json:"kind"` // include or require
+	Pos  PosInfo `json:"pos"`
+}
+
+// NewGraph returns a new, empty graph.
+func NewGraph() *Graph {
+	return &Graph{seen: make(map[string]bool)}
+}
+
+func (g *Graph) addFile(path string) {
+	if !g.seen[path] {
+		g.seen[path] = true
+		g.Files = append(g.Files, path)
+	}
+}
+
+func (g *Graph) addEdge(e Edge) {
+	g.addFile(e.From)
+	g.addFile(e.To)
+	g.Edges = append(g.Edges, e)
+}
+
+// Roots returns the files that are not included or required by any other
+// file in the graph, in the order in which they were first read.
+func (g *Graph) Roots() []string {
+	included := make(map[string]bool)
+	for _, e := range g.Edges {
+		included[e.To] = true
+	}
+	var roots []string
+	for _, f := range g.Files {
+		if !included[f] {
+			roots = append(roots, f)
+		}
+	}
+	return roots
+}
+
+// Affected returns the roots whose output may change if the file at path
+// changes, because they include or require it directly or indirectly.
+// If path is itself a root, it is also returned.
+func (g *Graph) Affected(path string) []string {
+	if !g.seen[path] {
+		path = resolve(path)
+	}
+	from := make(map[string][]string)
+	for _, e := range g.Edges {
+		from[e.To] = append(from[e.To], e.From)
+	}
+	affected := map[string]bool{path: true}
+	queue := []string{path}
+	for len(queue) > 0 {
+		f := queue[0]
+		queue = queue[1:]
+		for _, parent := range from[f] {
+			if !affected[parent] {
+				affected[parent] = true
+				queue = append(queue, parent)
+			}
+		}
+	}
+	var roots []string
+	for _, f := range g.Roots() {
+		if affected[f] {
+			roots = append(roots, f)
+		}
+	}
+	return roots
+}
+
+// Sort returns the files in topological order, so that every file comes
+// after all the files that it includes or requires. Files that require
+// each other in a cycle are ordered as they were first read.
+func (g *Graph) Sort() []string {
+	to := make(map[string][]string)
+	for _, e := range g.Edges {
+		to[e.From] = append(to[e.From], e.To)
+	}
+	files := make([]string, 0, len(g.Files))
+	visited := make(map[string]bool)
+	var visit func(f string)
+	visit = func(f string) {
+		if visited[f] {
+			return
+		}
+		visited[f] = true
+		for _, dep := range to[f] {
+			visit(dep)
+		}
+		files = append(files, f)
+	}
+	for _, f := range g.Files {
+		visit(f)
+	}
+	return files
+}
+
+// WriteJSON writes the graph to w as a JSON object.
+func (g *Graph) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g)
+}
+
+// WriteDOT writes the graph to w in the DOT language of Graphviz.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph includes {")
+	for _, f := range g.Files {
+		fmt.Fprintf(bw, "\t%s;\n", strconv.Quote(f))
+	}
+	for _, e := range g.Edges {
+		label := fmt.Sprintf("%s at %d:%d", e.Kind, e.Pos.Line, e.Pos.Column)
+		fmt.Fprintf(bw, "\t%s -> %s [label=%s];\n", strconv.Quote(e.From), strconv.Quote(e.To), strconv.Quote(label))
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
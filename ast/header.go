@@ -0,0 +1,93 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import "strings"
+
+// headerState tracks the leading comment block of the root file while
+// it is being parsed, so that it can be replaced by Parser.Header.
+type headerState struct {
+	seen    bool    // at least one header comment has been removed
+	pending string  // whitespace that has not been added to the tree yet
+	raw     string  // source of pending
+	pi      PosInfo // position of pending
+}
+
+func (p *Parser) beginHeader() {
+	if p.HeaderLines > 0 {
+		p.hdr = &headerState{}
+	}
+}
+
+// headerComment returns true if the comment at pi is part of the header,
+// in which case it should not be added to the tree.
+func (p *Parser) headerComment(pi PosInfo) bool {
+	h := p.hdr
+	if h == nil {
+		return false
+	}
+	if pi.Line > p.HeaderLines {
+		p.endHeader("", "", PosInfo{})
+		return false
+	}
+
+	if !h.seen {
+		h.seen = true
+		if h.pending != "" {
+			p.addNode(&TextNode{h.pi, h.pending, h.raw})
+		}
+		if p.Header != "" {
+			p.addNode(&TextNode{pi, p.Header, ""})
+		}
+	}
+	h.pending, h.raw = "", ""
+	return true
+}
+
+// headerText returns true if the text s at pi, which has the source raw,
+// has been taken care of by the header, in which case it should not be
+// added to the tree.
+func (p *Parser) headerText(s, raw string, pi PosInfo) bool {
+	h := p.hdr
+	if h == nil {
+		return false
+	}
+	if strings.TrimSpace(s) == "" {
+		// Whitespace between header comments belongs to the header.
+		if h.pending == "" {
+			h.pi = pi
+		}
+		h.pending += s
+		h.raw += raw
+		return true
+	}
+	p.endHeader(s, raw, pi)
+	return true
+}
+
+// endHeader ends the header, adding the pending whitespace and the text s
+// at pi, which has the source raw, to the tree. If the header was removed,
+// the newline that ended it is removed as well.
+func (p *Parser) endHeader(s, raw string, pi PosInfo) {
+	h := p.hdr
+	if h == nil {
+		return
+	}
+	p.hdr = nil
+
+	if h.pending != "" {
+		s, raw, pi = h.pending+s, h.raw+raw, h.pi
+	}
+	if h.seen {
+		if strings.HasPrefix(s, "\r\n") {
+			s = s[2:]
+		} else if strings.HasPrefix(s, "\n") {
+			s = s[1:]
+		}
+	}
+	if s != "" {
+		p.addNode(&TextNode{pi, s, raw})
+	}
+}
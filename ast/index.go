@@ -0,0 +1,192 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+)
+
+// An Index records from where each file is included. A single Index can be
+// shared by several parsers to build an index of an entire template tree.
+type Index struct {
+	refs map[string][]reference
+}
+
+// A reference is a command at PosInfo in the file at path that includes
+// or requires a file.
+type reference struct {
+	PosInfo
+	path string // resolved path of the including file
+}
+
+// NewIndex returns a new, empty index.
+func NewIndex() *Index {
+	return &Index{refs: make(map[string][]reference)}
+}
+
+// Files returns the resolved paths of all files that are referenced, sorted.
+func (x *Index) Files() []string {
+	files := make([]string, 0, len(x.refs))
+	for f := range x.refs {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// ReferencesTo returns the positions of all commands that include or
+// require the file at path, in the order in which they were parsed.
+// This includes require commands that skipped the file because it had
+// already been read.
+func (x *Index) ReferencesTo(path string) []PosInfo {
+	refs := x.references(path)
+	if refs == nil {
+		return nil
+	}
+	pis := make([]PosInfo, len(refs))
+	for i, r := range refs {
+		pis[i] = r.PosInfo
+	}
+	return pis
+}
+
+func (x *Index) references(path string) []reference {
+	if refs, ok := x.refs[path]; ok {
+		return refs
+	}
+	return x.refs[resolve(path)]
+}
+
+// Rename returns the sources of all files that include or require the file
+// at from, edited to include the file at to instead, keyed by the resolved
+// paths of the files. Only the paths in the commands are changed, and they
+// stay absolute if they were, or are otherwise relative to the including
+// file, with forward slashes. The sources are read from the file system,
+// so it should not have changed since the index was built. Paths that are
+// not written as they are resolved, such as those bound by an IncludeMap,
+// are not changed. Files are not written, nor is the file at from moved.
+func (x *Index) Rename(from, to string) (map[string][]byte, error) {
+	target := resolve(from)
+	dst, err := filepath.Abs(to)
+	if err != nil {
+		return nil, err
+	}
+	lines := make(map[string]map[int]bool)
+	for _, r := range x.references(from) {
+		if _, file := splitArchive(r.path); r.path == "" || file != "" {
+			continue
+		}
+		if lines[r.path] == nil {
+			lines[r.path] = make(map[int]bool)
+		}
+		lines[r.path][r.Line] = true
+	}
+
+	edits := make(map[string][]byte)
+	for path, ls := range lines {
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		dir := filepath.Dir(path)
+		repl := func(name string) (string, bool) {
+			if resolve(includePath(dir, name)) != target {
+				return "", false
+			}
+			if filepath.IsAbs(filepath.FromSlash(name)) {
+				return dst, true
+			}
+			rel, err := filepath.Rel(dir, dst)
+			if err != nil {
+				return dst, true
+			}
+			return filepath.ToSlash(rel), true
+		}
+		out := renameInLines(src, ls, repl)
+		if !bytes.Equal(out, src) {
+			edits[path] = out
+		}
+	}
+	return edits, nil
+}
+
+// renameInLines returns src with the double-quoted strings on the lines in
+// ls replaced by repl, where it returns true.
+func renameInLines(src []byte, ls map[int]bool, repl func(string) (string, bool)) []byte {
+	var out bytes.Buffer
+	line := 1
+	for len(src) > 0 {
+		i := bytes.IndexByte(src, '\n') + 1
+		if i == 0 {
+			i = len(src)
+		}
+		s := src[:i]
+		src = src[i:]
+		if ls[line] {
+			s = renameStrings(s, repl)
+		}
+		out.Write(s)
+		line++
+	}
+	return out.Bytes()
+}
+
+// renameStrings returns s with each double-quoted string replaced by repl,
+// where it returns true. A backslash escapes the character after it.
+func renameStrings(s []byte, repl func(string) (string, bool)) []byte {
+	var out []byte
+	for {
+		i := bytes.IndexByte(s, '"')
+		if i < 0 {
+			return append(out, s...)
+		}
+		j := i + 1
+		for j < len(s) && s[j] != '"' && s[j] != '\n' {
+			if s[j] == '\\' {
+				j++
+			}
+			j++
+		}
+		if j >= len(s) || s[j] != '"' {
+			return append(out, s...)
+		}
+		out = append(out, s[:i+1]...)
+		if v, ok := repl(string(s[i+1 : j])); ok {
+			out = append(out, v...)
+		} else {
+			out = append(out, s[i+1:j]...)
+		}
+		out = append(out, '"')
+		s = s[j+1:]
+	}
+}
+
+// resolve returns the absolute path of path with symbolic links evaluated,
+// as the parser records it, or path itself if that is not possible.
+func resolve(name string) string {
+	return resolveIn(OSFileSystem{}, name)
+}
+
+// resolveIn is the same as resolve, but for the file system fs.
+func resolveIn(fs FileSystem, name string) string {
+	path, file := splitArchive(name)
+	if abs, err := fs.Abs(path); err == nil {
+		path = abs
+		if real, err := fs.EvalSymlinks(abs); err == nil {
+			path = real
+		}
+	}
+	if file != "" {
+		path += archiveSep + file
+	}
+	return path
+}
+
+func (x *Index) add(path string, pi PosInfo, from string) {
+	x.refs[path] = append(x.refs[path], reference{pi, from})
+}
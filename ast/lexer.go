@@ -4,109 +4,311 @@
 
 package ast
 
-import "github.com/goulash/lex"
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/goulash/lex"
+)
 
 const (
 	// We continue where the reserved types left off
 	typeText lex.Type = (lex.TypeEOF + 1) + iota
 	typeComment
 
+	typeBuiltin
+
 	typeActionBegin
 	typeActionEnd
 	typeIdent
 	typeString
+	typeLongString
+	typeNumber
+	typeRaw
 
 	typeExclamation // '!'
 	typeSlash       // '/'
+	typeQuestion    // '?'
+	typeEquals      // '='
 )
 
-// stringOfType is useful for debugging.
-func stringOfType(t lex.Type) string {
+// A TokenType is the type of a token produced by the lexer. Its String
+// method names the token in error messages about unexpected tokens.
+type TokenType lex.Type
+
+// The token types produced by the lexer.
+const (
+	TokenError       = TokenType(lex.TypeError)
+	TokenEOF         = TokenType(lex.TypeEOF)
+	TokenText        = TokenType(typeText)
+	TokenComment     = TokenType(typeComment)
+	TokenBuiltin     = TokenType(typeBuiltin)
+	TokenActionBegin = TokenType(typeActionBegin)
+	TokenActionEnd   = TokenType(typeActionEnd)
+	TokenIdent       = TokenType(typeIdent)
+	TokenString      = TokenType(typeString)
+	TokenLongString  = TokenType(typeLongString)
+	TokenNumber      = TokenType(typeNumber)
+	TokenRaw         = TokenType(typeRaw)
+	TokenExclamation = TokenType(typeExclamation)
+	TokenSlash       = TokenType(typeSlash)
+	TokenQuestion    = TokenType(typeQuestion)
+	TokenEquals      = TokenType(typeEquals)
+)
+
+func (t TokenType) String() string {
 	switch t {
-	case typeText:
+	case TokenText:
 		return "text"
-	case typeComment:
+	case TokenComment:
 		return "comment"
-	case typeActionBegin:
-		return "_begin"
-	case typeActionEnd:
-		return "_end"
-	case typeIdent:
-		return "_ident"
-	case typeString:
-		return "_string"
-	case typeExclamation:
-		return "_exclam"
-	case typeSlash:
-		return "_slash"
-	case lex.TypeError:
+	case TokenBuiltin:
+		return "builtin"
+	case TokenActionBegin:
+		return "directive"
+	case TokenActionEnd:
+		return "end of directive"
+	case TokenIdent:
+		return "identifier"
+	case TokenString:
+		return "string"
+	case TokenLongString:
+		return "triple-quoted string"
+	case TokenNumber:
+		return "number"
+	case TokenRaw:
+		return "<file>"
+	case TokenExclamation:
+		return "'!'"
+	case TokenSlash:
+		return "'/'"
+	case TokenQuestion:
+		return "'?'"
+	case TokenEquals:
+		return "'='"
+	case TokenError:
 		return "error"
-	case lex.TypeEOF:
-		return "eof"
+	case TokenEOF:
+		return "EOF"
 	default:
-		return "unknown"
+		return fmt.Sprintf("TokenType(%d)", int(t))
 	}
 }
 
+// expectError returns the error for the tokens of a failed Expect: the
+// error of the lexer, if it failed, or else msg and the unexpected token.
+func expectError(toks []lex.Token, msg string) error {
+	tok := toks[len(toks)-1]
+	if tok.Type == lex.TypeError {
+		return errors.New(tok.Value)
+	}
+	return fmt.Errorf("%s, found %s", msg, TokenType(tok.Type))
+}
+
 // lexText scans until an action of the end of the text.
 // lexText expects to start at the beginning of a line.
 func (p *Parser) lexText(l *lex.Lexer) lex.StateFn {
+	if p.stopped() {
+		return nil
+	}
+	if l.Pos() == 0 && p.plainText(l.Input(0)) {
+		// There is nothing but text, so there is no need to look at it.
+		l.Inc(len(l.Input(0)))
+		p.emitText(l)
+		l.Emit(lex.TypeEOF)
+		return nil
+	}
 	for {
 		n := l.AcceptRun(lex.Space)
 		// We accept the trigger if the rune before the whitespace is a newline.
 		if l.HasPrefix(p.Trigger) && (l.Pos() == n || l.Input(-n - 1)[0] == '\n') {
-			l.Dec(n) // don't include leading space in text
-			if l.Len() > 0 {
-				l.Emit(typeText)
+			if p.EscapeTrigger && l.HasPrefix(p.Trigger+p.Trigger) {
+				// Drop the first trigger and keep the rest of the line as text.
+				p.emitText(l)
+				l.Inc(len(p.Trigger))
+				l.Ignore()
+				l.Inc(len(p.Trigger))
+				continue
 			}
+			l.Dec(n) // don't include leading space in text
+			p.emitText(l)
 			l.Inc(n)
 			l.Ignore()
 			return p.lexActionBegin
 		}
-		if p.Commenters.IsComment(l.Input(0)) {
-			if l.Len() > 0 {
-				l.Emit(typeText)
+		if r := l.Peek(); r != lex.EOF && strings.ContainsRune(p.Quotes, r) {
+			skipQuoted(l, r)
+			continue
+		}
+		if c := p.Commenters.FirstAt(l.Input(0), atLineStart(l)); c != nil {
+			p.emitText(l)
+			if c.directiveAt(l.Input(0)) {
+				return p.lexCommentDirective
 			}
 			return p.lexComment
 		}
+		if name := p.builtinAt(l); name != "" {
+			p.emitText(l)
+			l.Inc(len(name))
+			l.Emit(typeBuiltin)
+			continue
+		}
 
-		// We don't have a space, it's not a comment or trigger, so make sure
-		// it's not an EOF. Otherwise, we will move on to the next rune.
+		// We don't have a space, it's not a comment or trigger, so we skip
+		// to the next rune that may begin one, which is much faster than
+		// checking every rune of long lines. Newlines are never skipped.
+		if i := strings.IndexAny(l.Input(0), p.stopRunes()); i > 0 {
+			l.Inc(i)
+			continue
+		} else if i < 0 {
+			l.Inc(len(l.Input(0)))
+			break
+		}
+		// Make sure it's not an EOF. Otherwise, we will move on to the next rune.
 		if l.Next() == lex.EOF {
 			break
 		}
 	}
 	// Correctly reached EOF.
-	if l.Len() > 0 {
-		l.Emit(typeText)
-	}
+	p.emitText(l)
 	l.Emit(lex.TypeEOF)
 	return nil
 }
 
+// stopped returns true if parsing failed, so that the lexer can stop
+// instead of lexing input that is only discarded.
+func (p *Parser) stopped() bool {
+	return p.failed != nil && atomic.LoadInt32(p.failed) != 0
+}
+
+// stopRunes returns the runes that may begin something other than text
+// in lexText: a newline, before which a trigger may follow, a quote, a
+// comment, or a builtin or symbol. Since lexers run concurrently with the
+// parser, it must first be called before any lexer is started.
+func (p *Parser) stopRunes() string {
+	if p.stops != "" {
+		return p.stops
+	}
+	var b strings.Builder
+	b.WriteString("\n")
+	b.WriteString(p.Quotes)
+	for _, c := range p.Commenters {
+		if r, _ := utf8.DecodeRuneInString(c.Begin); r != utf8.RuneError {
+			b.WriteRune(r)
+		}
+	}
+	if p.Builtins || p.PlatformBuiltins {
+		b.WriteString("_")
+	}
+	for name := range p.Symbols {
+		if r, _ := utf8.DecodeRuneInString(name); r != utf8.RuneError {
+			b.WriteRune(r)
+		}
+	}
+	p.stops = b.String()
+	return p.stops
+}
+
+// emitText emits the text up to the current position, if there is any.
+// If MaxTokenSize is greater than zero, the text is split into tokens of
+// at most MaxTokenSize bytes, without splitting runes.
+func (p *Parser) emitText(l *lex.Lexer) {
+	n := l.Len()
+	for p.MaxTokenSize > 0 && n > p.MaxTokenSize {
+		text := l.Input(-n)
+		k := p.MaxTokenSize
+		for k > 0 && !utf8.RuneStart(text[k]) {
+			k--
+		}
+		if k == 0 {
+			// A single rune is longer than MaxTokenSize.
+			_, k = utf8.DecodeRuneInString(text)
+		}
+		l.Dec(n - k)
+		l.Emit(typeText)
+		l.Inc(n - k)
+		n -= k
+	}
+	if n > 0 {
+		l.Emit(typeText)
+	}
+}
+
+// plainText returns true if src contains neither the trigger, nor the
+// beginning of a comment, nor a builtin or symbol, so that all of src is
+// text. This is much faster to find out than lexing src.
+func (p *Parser) plainText(src string) bool {
+	if strings.Contains(src, p.Trigger) {
+		return false
+	}
+	for _, c := range p.Commenters {
+		if strings.Contains(src, c.Begin) {
+			return false
+		}
+	}
+	for _, b := range p.builtinNames() {
+		if strings.Contains(src, b) {
+			return false
+		}
+	}
+	for name := range p.Symbols {
+		if strings.Contains(src, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// skipQuoted consumes a string literal in the text that begins with the
+// quote q, so that comment markers inside of it are not recognized.
+// The literal ends at the matching quote or at the end of the line.
+func skipQuoted(l *lex.Lexer, q rune) {
+	l.Next() // opening quote
+	stops := string(q) + "\\\n"
+	for {
+		// Skip the runes of the literal that cannot end it.
+		if i := strings.IndexAny(l.Input(0), stops); i > 0 {
+			l.Inc(i)
+		}
+		switch l.Next() {
+		case '\\':
+			l.Next()
+		case q, '\n', lex.EOF:
+			return
+		}
+	}
+}
+
 // lexComment scans a comment, because the trigger doesn't count in a comment.
 // The comment includes the //, /* */, or whatever.
 func (p *Parser) lexComment(l *lex.Lexer) lex.StateFn {
 	// Find out which kind of comment we have, so we know how to deal with it.
-	c := p.Commenters.First(l.Input(0))
+	c := p.Commenters.FirstAt(l.Input(0), atLineStart(l))
 
 	l.Inc(len(c.Begin))
-	var end = c.End
-	if end == "" {
-		end = "\n"
-	}
-	for !l.Consume(end) && l.Next() != lex.EOF {
-		// absorb as long as we don't hit EOF or end-of-comment
-	}
 	if c.End == "" {
-		l.Dec(1)
+		// A line comment ends before the newline, or at the end of the file.
+		if i := strings.IndexByte(l.Input(0), '\n'); i >= 0 {
+			l.Inc(i)
+		} else {
+			l.Inc(len(l.Input(0)))
+		}
+	} else {
+		for !l.Consume(c.End) && l.Next() != lex.EOF {
+			// absorb as long as we don't hit EOF or end-of-comment
+		}
 	}
 
-	if c.Strip {
-		l.Ignore()
-	} else {
-		l.Emit(typeComment)
+	if p.MaxTokenSize > 0 && l.Len() > p.MaxTokenSize {
+		return l.Errorf("comment of %d bytes exceeds maximum token size of %d bytes", l.Len(), p.MaxTokenSize)
 	}
+
+	// Stripped comments are also emitted, so that the parser knows about them.
+	l.Emit(typeComment)
 	// If we exited because of EOF, then Peek will also return EOF.
 	if l.Peek() == lex.EOF {
 		l.Emit(lex.TypeEOF)
@@ -115,13 +317,56 @@ func (p *Parser) lexComment(l *lex.Lexer) lex.StateFn {
 	return p.lexText
 }
 
+// atLineStart returns true if the lexer is at the beginning of a line.
+func atLineStart(l *lex.Lexer) bool {
+	return l.Pos() == 0 || l.Input(-1)[0] == '\n'
+}
+
+// lexCommentDirective scans the beginning of a comment that is a directive,
+// up to and including the Directive of its Commenter, as a trigger.
+func (p *Parser) lexCommentDirective(l *lex.Lexer) lex.StateFn {
+	c := p.Commenters.FirstAt(l.Input(0), atLineStart(l))
+	l.Inc(len(c.Begin))
+	l.AcceptRun(" \t")
+	l.Inc(len(c.Directive))
+	l.Emit(typeActionBegin)
+	if c.End != "" {
+		p.commentEnds.Store(l, c.End)
+	}
+	return p.lexInsideAction
+}
+
+// commentDirectiveEnd returns the End of the Commenter of the comment
+// directive that the lexer is in, if it is at it, or the empty string.
+// Lexers run concurrently with the parser and with each other, so the
+// comment that each is in is kept in commentEnds, by lexer.
+func (p *Parser) commentDirectiveEnd(l *lex.Lexer) string {
+	if p.commentEnds == nil {
+		return ""
+	}
+	if end, ok := p.commentEnds.Load(l); ok && l.HasPrefix(end.(string)) {
+		return end.(string)
+	}
+	return ""
+}
+
 func (p *Parser) lexActionBegin(l *lex.Lexer) lex.StateFn {
 	l.Inc(len(p.Trigger))
 	l.Emit(typeActionBegin)
 	return p.lexInsideAction
 }
 
+// lexActionEnd scans the end of the line that ends an action. An action on
+// the last line of a file may also end at the end of the file.
 func (p *Parser) lexActionEnd(l *lex.Lexer) lex.StateFn {
+	if p.commentEnds != nil {
+		p.commentEnds.Delete(l)
+	}
+	if l.Peek() == lex.EOF {
+		l.Emit(typeActionEnd)
+		l.Emit(lex.TypeEOF)
+		return nil
+	}
 	if !(l.Consume("\n") || l.Consume("\r\n")) {
 		return l.Errorf("malformed end-of-line")
 	}
@@ -137,46 +382,90 @@ func (p *Parser) lexSpace(l *lex.Lexer) lex.StateFn {
 	return p.lexInsideAction
 }
 
-// lexQuote scans all the string inside a quote.
-// Only double-quote is supported at the moment.
+// lexQuote scans all the string inside a quote, which must be one of the
+// Quotes of the Quoting of the parser.
 func (p *Parser) lexQuote(l *lex.Lexer) lex.StateFn {
-	// lexQuote is called for ', ", and `.
-	if l.Next() != '"' {
-		return l.Errorf("only support double-quoted strings")
+	// lexQuote is called for ', ", and `, and the Quotes of the Quoting.
+	q := l.Next()
+	if !p.isQuote(q) {
+		if p.KeepDirectives {
+			return p.lexRaw
+		}
+		return l.Errorf("strings cannot be quoted with %c", q)
+	}
+	if q == '"' && l.HasPrefix(`""`) {
+		return p.lexTripleQuote
 	}
 	l.Ignore()
 
-loop:
+	esc := p.quoting().Escape
 	for {
-		switch l.Next() {
-		case '\\':
-			if r := l.Next(); r != lex.EOF && r != '\n' {
-				break
+		r := l.Next()
+		if r == q {
+			break
+		}
+		if r == esc && esc != 0 {
+			if r = l.Next(); r != lex.EOF && r != '\n' {
+				continue
 			}
-			fallthrough
-		case lex.EOF, '\n':
+		}
+		if r == lex.EOF || r == '\n' {
 			return l.Errorf("unterminated quoted string")
-		case '"':
-			break loop
 		}
 	}
-	l.Dec(1)
+	w := utf8.RuneLen(q)
+	l.Dec(w)
 	l.Emit(typeString)
-	l.Inc(1)
+	l.Inc(w)
+	l.Ignore()
+	return p.lexInsideAction
+}
+
+// lexTripleQuote scans a string delimited by three double-quotes, such as
+//
+//  """He said "hi"
+//  and left."""
+//
+// which may contain newlines and quotes. Backslashes have no special
+// meaning in it. The first quote has already been read.
+func (p *Parser) lexTripleQuote(l *lex.Lexer) lex.StateFn {
+	l.Inc(2)
+	l.Ignore()
+	for !l.HasPrefix(`"""`) {
+		if l.Next() == lex.EOF {
+			return l.Errorf("unterminated triple-quoted string")
+		}
+	}
+	l.Emit(typeLongString)
+	l.Inc(3)
 	l.Ignore()
 	return p.lexInsideAction
 }
 
 func (p *Parser) lexInsideAction(l *lex.Lexer) lex.StateFn {
+	if p.stopped() {
+		return nil
+	}
+	if end := p.commentDirectiveEnd(l); end != "" {
+		p.commentEnds.Delete(l)
+		l.Inc(len(end))
+		if !l.Consume("\n") {
+			l.Consume("\r\n")
+		}
+		l.Emit(typeActionEnd)
+		return p.lexText
+	}
 	switch r := l.Peek(); {
 	case lex.IsEndline(r):
 		return p.lexActionEnd
 	case lex.IsSpace(r):
 		return p.lexSpace
-	case lex.IsQuote(r):
+	case lex.IsQuote(r) || p.isQuote(r):
 		return p.lexQuote
-	case lex.IsAlphaNumeric(r):
-		return p.lexAlphaNumeric
+	case isDigit(r) || r == '-':
+		return p.lexNumber
+	case isIdent(r):
+		return p.lexIdent
 	case r == '!':
 		l.Next()
 		l.Emit(typeExclamation)
@@ -185,15 +474,88 @@ func (p *Parser) lexInsideAction(l *lex.Lexer) lex.StateFn {
 		l.Next()
 		l.Emit(typeSlash)
 		return p.lexInsideAction
+	case r == '?':
+		l.Next()
+		l.Emit(typeQuestion)
+		return p.lexInsideAction
+	case r == '=':
+		l.Next()
+		l.Emit(typeEquals)
+		return p.lexInsideAction
+	case p.atContinuation(l):
+		l.Consume("\\")
+		l.Consume("\r")
+		l.Consume("\n")
+		l.Ignore()
+		return p.lexInsideAction
 	case r == lex.EOF:
-		return l.Errorf("unexpected EOF")
+		return p.lexActionEnd
+	case p.KeepDirectives || r == '<' && len(p.IncludePaths) > 0:
+		return p.lexRaw
 	default:
 		return l.Errorf("unexpected rune: %v", r)
 	}
 }
 
-func (p *Parser) lexAlphaNumeric(l *lex.Lexer) lex.StateFn {
-	l.AcceptFuncRun(lex.IsAlphaNumeric)
+// lexRaw scans runes that pre does not understand up to the next space or
+// end-of-line. It is used if KeepDirectives is true, so that directives
+// meant for another preprocessor can be passed through, and for the <file>
+// of includes if there are IncludePaths.
+func (p *Parser) lexRaw(l *lex.Lexer) lex.StateFn {
+	for {
+		r := l.Peek()
+		if r == lex.EOF || lex.IsSpace(r) || lex.IsEndline(r) || p.atContinuation(l) {
+			break
+		}
+		l.Next()
+	}
+	l.Emit(typeRaw)
+	return p.lexInsideAction
+}
+
+// atContinuation returns true if the lexer is at a backslash that ends
+// the line and LineContinuation is true.
+func (p *Parser) atContinuation(l *lex.Lexer) bool {
+	return p.LineContinuation && (l.HasPrefix("\\\n") || l.HasPrefix("\\\r\n"))
+}
+
+// lexIdent scans an identifier, which consists of Unicode letters, digits,
+// and underscores, as well as hyphens between letters, as in strip-comments.
+func (p *Parser) lexIdent(l *lex.Lexer) lex.StateFn {
+	l.AcceptFuncRun(isIdent)
+	for l.HasPrefix("-") {
+		r, _ := utf8.DecodeRuneInString(l.Input(1))
+		if !unicode.IsLetter(r) {
+			break
+		}
+		l.Next()
+		l.AcceptFuncRun(isIdent)
+	}
 	l.Emit(typeIdent)
 	return p.lexInsideAction
 }
+
+func isIdent(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// isDigit is unlike unicode.IsDigit in that it only accepts 0-9,
+// since these are the only digits that numbers may consist of.
+func isDigit(r rune) bool {
+	return '0' <= r && r <= '9'
+}
+
+// lexNumber scans an integer or decimal number, such as 42, -1, or 0.5.
+func (p *Parser) lexNumber(l *lex.Lexer) lex.StateFn {
+	l.Consume("-")
+	if l.AcceptFuncRun(isDigit) == 0 ||
+		l.Consume(".") && l.AcceptFuncRun(isDigit) == 0 ||
+		isIdent(l.Peek()) {
+		if p.KeepDirectives {
+			return p.lexRaw
+		}
+		return l.Errorf("malformed number")
+	}
+	l.Emit(typeNumber)
+	return p.lexInsideAction
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/goulash/lex"
+)
+
+// A Macro is a definition made with the define command:
+//
+//  #define NAME
+//  #define NAME "value"
+//  #define NAME """value with "quotes"
+//  and newlines"""
+//
+// The value of a macro without a value is the empty string.
+type Macro struct {
+	PosInfo
+	Name  string
+	Value string
+
+	// Source is how the macro was defined. PosInfo is only meaningful
+	// for SourceDefine and SourceParameter.
+	Source Source
+
+	// Prev is the definition that this one replaced, if any.
+	Prev *Macro
+}
+
+// A Source describes how a macro was defined.
+type Source int
+
+const (
+	SourceDefine      Source = iota // define command in a file
+	SourceParameter                 // parameter of an include command
+	SourceAPI                       // call of a function, such as Processor.Define
+	SourceCommandLine               // command line argument
+	SourceEnvironment               // environment variable
+	SourceConfig                    // configuration file
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceDefine:
+		return "define"
+	case SourceParameter:
+		return "parameter"
+	case SourceAPI:
+		return "api"
+	case SourceCommandLine:
+		return "command line"
+	case SourceEnvironment:
+		return "environment"
+	case SourceConfig:
+		return "config"
+	default:
+		return "unknown"
+	}
+}
+
+// Definitions returns all macros defined while parsing, by name. Use
+// SortedDefinitions to enumerate them in a deterministic order.
+// If a macro was defined more than once, the last definition is returned,
+// and the earlier ones can be followed through Prev.
+func (p *Parser) Definitions() map[string]Macro {
+	defs := make(map[string]Macro, len(p.defs))
+	for k, m := range p.defs {
+		defs[k] = m
+	}
+	return defs
+}
+
+// SortedDefinitions returns the macros of Definitions sorted by name.
+func (p *Parser) SortedDefinitions() []Macro {
+	defs := make([]Macro, 0, len(p.defs))
+	for _, m := range p.defs {
+		defs = append(defs, m)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	return defs
+}
+
+func (p *Parser) parseCmdDefine(r *lex.Reader) (parseFn, error) {
+	pi := p.posInfo(r)
+	args, err := p.parseArgs(r)
+	if err != nil {
+		if p.KeepDirectives {
+			// Such as #define MAX(a, b) ..., which is for the C preprocessor.
+			return p.keepDirective(r, pi, r.Next())
+		}
+		return nil, err
+	}
+	p.onCommand(pi, "define", args)
+	m, err := macroOf(pi, args)
+	if err != nil {
+		if p.KeepDirectives {
+			p.addLines(pi, p.posInfo(r).Line)
+			return p.parseNext, nil
+		}
+		return nil, err
+	}
+
+	if err := p.define(m); err != nil {
+		return nil, err
+	}
+	if p.KeepDirectives {
+		p.addLines(pi, p.posInfo(r).Line)
+	}
+	return p.parseNext, nil
+}
+
+// macroOf returns the macro defined at pi by the arguments of define.
+func macroOf(pi PosInfo, args []Arg) (Macro, error) {
+	if len(args) == 0 || len(args) > 2 || args[0].Type != IdentArg || args[0].Key != "" {
+		return Macro{}, fmt.Errorf("command define takes a name and an optional value")
+	}
+
+	m := Macro{
+		PosInfo: pi,
+		Name:    args[0].Value,
+	}
+	if len(args) == 2 {
+		if args[1].Key != "" || args[1].Type == IdentArg {
+			return Macro{}, fmt.Errorf("value of macro %s must be a string, number, or bool", m.Name)
+		}
+		m.Value = args[1].Value
+	}
+	return m, nil
+}
+
+// site returns where m was defined, for use in messages.
+func (m Macro) site() string {
+	if m.Source == SourceDefine || m.Source == SourceParameter {
+		return m.PosInfo.String()
+	}
+	return m.Source.String()
+}
+
+// A Redefinition decides what happens when a macro that is already defined
+// is defined again with a different value.
+type Redefinition int
+
+const (
+	RedefineLast  Redefinition = iota // the new definition replaces the old
+	RedefineFirst                     // the old definition is kept
+	RedefineWarn                      // like RedefineLast, with a diagnostic
+	RedefineError                     // the new definition is an error
+)
+
+// define defines the macro m, replacing any previous definition according
+// to Redefine. Parameters of include commands always replace definitions,
+// since they only apply to the included file.
+func (p *Parser) define(m Macro) error {
+	if p.defs == nil {
+		p.defs = make(map[string]Macro)
+	}
+	prev, ok := p.defs[m.Name]
+	if ok {
+		m.Prev = &prev
+	}
+	if ok && prev.Value != m.Value && m.Source != SourceParameter {
+		switch p.Redefine {
+		case RedefineFirst:
+			return nil
+		case RedefineWarn:
+			p.diagnose(m.PosInfo, "redefined-macro", "macro %s redefined, previous definition at %s", m.Name, prev.site())
+		case RedefineError:
+			return fmt.Errorf("macro %s redefined, previous definition at %s", m.Name, prev.site())
+		}
+	}
+	p.defs[m.Name] = m
+	return nil
+}
+
+// predefine defines all the macros in Defines.
+func (p *Parser) predefine() error {
+	for _, m := range p.Defines {
+		if err := p.define(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Metrics count how many times each command was run in each file, so that
+// it can be seen which commands the files actually use. Metrics may be used
+// by several parsers at once.
+type Metrics struct {
+	mu     sync.Mutex
+	counts map[CommandCount]int
+}
+
+// CommandCount is the number of times that the command Name was run in the
+// file File, which is named as in positions.
+type CommandCount struct {
+	Name  string
+	File  string
+	Count int
+}
+
+// NewMetrics returns new, empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{counts: make(map[CommandCount]int)}
+}
+
+// Counts returns the counts of all commands in all files, sorted by
+// command name and then by file.
+func (m *Metrics) Counts() []CommandCount {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cs := make([]CommandCount, 0, len(m.counts))
+	for k, n := range m.counts {
+		k.Count = n
+		cs = append(cs, k)
+	}
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].Name != cs[j].Name {
+			return cs[i].Name < cs[j].Name
+		}
+		return cs[i].File < cs[j].File
+	})
+	return cs
+}
+
+// Commands returns how many times each command was run over all files.
+func (m *Metrics) Commands() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cmds := make(map[string]int)
+	for k, n := range m.counts {
+		cmds[k.Name] += n
+	}
+	return cmds
+}
+
+// WritePrometheus writes the counts in the Prometheus text format, as the
+// counter pre_commands_total with the labels command and file.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# HELP pre_commands_total Number of times each command was run in each file.")
+	fmt.Fprintln(bw, "# TYPE pre_commands_total counter")
+	for _, c := range m.Counts() {
+		fmt.Fprintf(bw, "pre_commands_total{command=%s,file=%s} %d\n",
+			promLabel(c.Name), promLabel(c.File), c.Count)
+	}
+	return bw.Flush()
+}
+
+// promLabel quotes s as a label value in the Prometheus text format, which
+// only escapes backslashes, double quotes and newlines.
+func promLabel(s string) string {
+	bs := []byte{'"'}
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\', '"':
+			bs = append(bs, '\\', s[i])
+		case '\n':
+			bs = append(bs, '\\', 'n')
+		default:
+			bs = append(bs, s[i])
+		}
+	}
+	return string(append(bs, '"'))
+}
+
+func (m *Metrics) add(name, file string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[CommandCount{Name: name, File: file}]++
+}
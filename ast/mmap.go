@@ -0,0 +1,48 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import "unsafe"
+
+// readSource reads the file name and returns its content both as bytes and
+// as the source to lex. If Mmap is true, the file is mapped into memory if
+// possible, and both share the mapping instead of being copied to the heap.
+func (p *Parser) readSource(name string) ([]byte, string, error) {
+	if isAngled(name) {
+		return p.readFragment(name)
+	}
+	if p.FS != nil {
+		bs, err := p.FS.ReadFile(name)
+		return bs, string(bs), err
+	}
+	_, file := splitArchive(name)
+	if file != "" && p.ResourceCache != nil {
+		bs, err := p.readCached(name)
+		return bs, string(bs), err
+	}
+	if p.Mmap && file == "" {
+		if bs, err := mmapFile(name); err == nil && len(bs) > 0 {
+			p.mapped = append(p.mapped, bs)
+			return bs, *(*string)(unsafe.Pointer(&bs)), nil
+		}
+		// Fall back to reading the file, which also reports the error.
+	}
+	bs, err := ReadFile(name)
+	return bs, string(bs), err
+}
+
+// Close releases the memory of the files that were mapped because Mmap is
+// true. The tree, and all strings obtained from it or from the parser,
+// must not be used afterwards.
+func (p *Parser) Close() error {
+	var err error
+	for _, bs := range p.mapped {
+		if e := munmap(bs); err == nil {
+			err = e
+		}
+	}
+	p.mapped = nil
+	return err
+}
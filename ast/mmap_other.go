@@ -0,0 +1,19 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package ast
+
+import "errors"
+
+// mmapFile is not supported on this system, so files are always read.
+func mmapFile(name string) ([]byte, error) {
+	return nil, errors.New("memory mapping is not supported")
+}
+
+func munmap(bs []byte) error {
+	return nil
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package ast
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the file name into memory read-only. An empty file
+// results in a nil slice, since it cannot be mapped.
+func mmapFile(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size == 0 || !fi.Mode().IsRegular() {
+		return nil, nil
+	}
+	if int64(int(size)) != size {
+		return nil, errors.New("file is too large to map")
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(bs []byte) error {
+	return syscall.Munmap(bs)
+}
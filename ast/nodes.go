@@ -7,6 +7,8 @@ package ast
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"sort"
 	"strings"
 )
 
@@ -20,6 +22,14 @@ type Node interface {
 	OffsetLC(line, col int) *PosInfo
 }
 
+// A Rawer is a Node that returns the source text that produced it, which
+// differs from String for text in which builtins or symbols were replaced.
+// All nodes in the AST are Rawers.
+type Rawer interface {
+	Node
+	Raw() string
+}
+
 // The NodeType data type describes the type of a Node.
 type NodeType int
 
@@ -102,10 +112,12 @@ func (p PosInfo) OffsetInLC(data string, line, col int) *PosInfo {
 type TextNode struct {
 	PosInfo
 	val string
+	raw string // source of val, empty if val was not in the source
 }
 
 func (n TextNode) Type() NodeType                  { return TextType }
 func (n TextNode) String() string                  { return n.val }
+func (n TextNode) Raw() string                     { return n.raw }
 func (n TextNode) Len() int                        { return len(n.val) }
 func (n TextNode) Offset(offset int) *PosInfo      { return n.OffsetIn(n.val, offset) }
 func (n TextNode) OffsetLC(line, col int) *PosInfo { return n.OffsetInLC(n.val, line, col) }
@@ -117,15 +129,30 @@ func (n TextNode) OffsetLC(line, col int) *PosInfo { return n.OffsetInLC(n.val,
 type CommentNode struct {
 	PosInfo
 	val string
+	raw string // source of val, which differs if Commenter.Expand is true
 	c   *Commenter
 }
 
 func (n CommentNode) Type() NodeType                  { return CommentType }
 func (n CommentNode) String() string                  { return n.val }
+func (n CommentNode) Raw() string                     { return n.raw }
 func (n CommentNode) Len() int                        { return len(n.val) }
 func (n CommentNode) Offset(offset int) *PosInfo      { return n.OffsetIn(n.val, offset) }
 func (n CommentNode) OffsetLC(line, col int) *PosInfo { return n.OffsetInLC(n.val, line, col) }
 
+// Commenter returns the Commenter that matched the comment.
+func (n CommentNode) Commenter() *Commenter { return n.c }
+
+// Body returns the text of the comment without the Begin and End markers
+// of its Commenter.
+func (n CommentNode) Body() string {
+	s := strings.TrimPrefix(n.val, n.c.Begin)
+	if n.c.End != "" {
+		s = strings.TrimSuffix(s, n.c.End)
+	}
+	return s
+}
+
 // }}}
 
 // FileNode {{{
@@ -134,6 +161,10 @@ type FileNode struct {
 	PosInfo
 	name  string
 	path  string
+	src   string
+	spans []span    // fates of the source, see Fate
+	fates bool      // whether spans are recorded
+	lines lineIndex // lines of src if fates is true, see Fate
 	root  *FileNode
 	nodes []Node
 }
@@ -148,6 +179,32 @@ func (fn FileNode) String() string {
 	return buf.String()
 }
 
+// WriteTo writes the text of fn to w, without first building it in memory
+// as String does.
+func (fn FileNode) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for _, n := range fn.nodes {
+		var k int64
+		var err error
+		if wt, ok := n.(io.WriterTo); ok {
+			k, err = wt.WriteTo(w)
+		} else {
+			var m int
+			m, err = io.WriteString(w, n.String())
+			k = int64(m)
+		}
+		total += k
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Raw returns the entire source of the file, including the directives and
+// stripped comments that are not part of the tree.
+func (fn FileNode) Raw() string { return fn.src }
+
 func (fn FileNode) Len() int {
 	var total int
 	for _, n := range fn.nodes {
@@ -179,6 +236,10 @@ func (fn FileNode) Offset(offset int) *PosInfo {
 	return nil
 }
 
+// Nodes returns the text and comment nodes of fn and of the files it
+// includes, in the order in which they occur in the output. This is also
+// the order in which they occur in the source, with the nodes of each
+// included file in place of the command that included it.
 func (fn FileNode) Nodes() []Node {
 	var nodes []Node
 	for _, n := range fn.nodes {
@@ -191,6 +252,112 @@ func (fn FileNode) Nodes() []Node {
 	return nodes
 }
 
+// Comments returns all comments in fn and the files it includes, in the
+// order in which they occur in the output. Comments that are stripped are
+// not part of the tree, and are thus not returned.
+func (fn FileNode) Comments() []*CommentNode {
+	var cs []*CommentNode
+	for _, n := range fn.Nodes() {
+		if n.Type() == CommentType {
+			cs = append(cs, n.(*CommentNode))
+		}
+	}
+	return cs
+}
+
+// CommentsByFile is the same as Comments, except that the comments are
+// grouped by the name of the file they occur in.
+func (fn FileNode) CommentsByFile() map[string][]*CommentNode {
+	m := make(map[string][]*CommentNode)
+	for _, c := range fn.Comments() {
+		m[c.Name] = append(m[c.Name], c)
+	}
+	return m
+}
+
+// A Range is the half-open range [Start, End) of byte offsets in the output.
+type Range struct {
+	Start int
+	End   int
+}
+
+// Ranges returns the ranges of the output of fn that each file contributes,
+// keyed by the resolved path of the file. Files that were not read from the
+// file system, such as the root of ParseString, are keyed by their name.
+func (fn FileNode) Ranges() map[string][]Range {
+	m := make(map[string][]Range)
+	fn.ranges(m, 0)
+	return m
+}
+
+// ranges adds the ranges of fn to m, given that the output of fn begins
+// at offset off, and returns the offset at which the output of fn ends.
+func (fn FileNode) ranges(m map[string][]Range, off int) int {
+	key := fn.id()
+	for _, n := range fn.nodes {
+		if n.Type() == FileType {
+			off = n.(*FileNode).ranges(m, off)
+			continue
+		}
+		k := n.Len()
+		if k == 0 {
+			continue
+		}
+		rs := m[key]
+		if i := len(rs) - 1; i >= 0 && rs[i].End == off {
+			rs[i].End += k
+		} else {
+			rs = append(rs, Range{off, off + k})
+		}
+		m[key] = rs
+		off += k
+	}
+	return off
+}
+
+// Path returns the resolved path of the file, or the empty string if fn was
+// not read from a file.
+func (fn FileNode) Path() string { return fn.path }
+
+// Dependencies returns the resolved paths of all files included by fn,
+// directly or indirectly, in the order in which they were first included.
+// Each file is returned only once, even if it was included several times.
+// Fragments are not files, so they are not returned.
+func (fn FileNode) Dependencies() []string {
+	var deps []string
+	fn.dependencies(&deps, make(map[string]bool))
+	return deps
+}
+
+// SortedDependencies is the same as Dependencies, except that the paths
+// are sorted.
+func (fn FileNode) SortedDependencies() []string {
+	deps := fn.Dependencies()
+	sort.Strings(deps)
+	return deps
+}
+
+func (fn FileNode) dependencies(deps *[]string, seen map[string]bool) {
+	for _, n := range fn.nodes {
+		if n.Type() == FileType {
+			c := n.(*FileNode)
+			if !seen[c.path] && !isAngled(c.path) {
+				seen[c.path] = true
+				*deps = append(*deps, c.path)
+			}
+			c.dependencies(deps, seen)
+		}
+	}
+}
+
+// id returns the path of fn, or its name if it was not read from a file.
+func (fn FileNode) id() string {
+	if fn.path == "" {
+		return fn.name
+	}
+	return fn.path
+}
+
 func (fn *FileNode) addNode(n Node) {
 	fn.nodes = append(fn.nodes, n)
 }
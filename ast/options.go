@@ -0,0 +1,89 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+// Options are the settings of a Parser that decide the syntax of files,
+// where they are found, and how deeply they may be nested, which can be
+// passed around and applied together with WithOptions. Settings that are
+// the zero value leave those of the Parser as they are. All other settings,
+// such as MaxSteps, are only set through the fields of the Parser.
+type Options struct {
+	Trigger         string
+	Commenters      Commenters
+	MaxIncludeDepth int
+	IncludePaths    []string
+	FS              FileSystem
+}
+
+// An Option changes one of the settings in Options. Options are an
+// alternative to setting the fields of the Parser directly, which continues
+// to work.
+type Option func(*Parser)
+
+// NewParser returns a Parser with the trigger # and a maximum include depth
+// of 128, to which the options opts are then applied.
+func NewParser(opts ...Option) *Parser {
+	p := &Parser{
+		Trigger:         "#",
+		MaxIncludeDepth: 128,
+	}
+	p.Apply(opts...)
+	return p
+}
+
+// Apply applies the options opts to p in order. It must not be called
+// while p is parsing.
+func (p *Parser) Apply(opts ...Option) {
+	for _, opt := range opts {
+		opt(p)
+	}
+}
+
+// WithOptions sets the settings of o that are not the zero value.
+func WithOptions(o Options) Option {
+	return func(p *Parser) {
+		if o.Trigger != "" {
+			p.Trigger = o.Trigger
+		}
+		if o.Commenters != nil {
+			p.Commenters = o.Commenters
+		}
+		if o.MaxIncludeDepth != 0 {
+			p.MaxIncludeDepth = o.MaxIncludeDepth
+		}
+		if o.IncludePaths != nil {
+			p.IncludePaths = o.IncludePaths
+		}
+		if o.FS != nil {
+			p.FS = o.FS
+		}
+	}
+}
+
+// WithTrigger sets the trigger that begins directives.
+func WithTrigger(t string) Option {
+	return func(p *Parser) { p.Trigger = t }
+}
+
+// WithCommenters sets the commenters, replacing any that are set.
+func WithCommenters(cs ...*Commenter) Option {
+	return func(p *Parser) { p.Commenters = cs }
+}
+
+// WithMaxIncludeDepth sets the maximum depth of nested includes.
+func WithMaxIncludeDepth(n int) Option {
+	return func(p *Parser) { p.MaxIncludeDepth = n }
+}
+
+// WithIncludePaths sets the directories that are searched for files
+// included with the syntax of the C preprocessor.
+func WithIncludePaths(dirs ...string) Option {
+	return func(p *Parser) { p.IncludePaths = dirs }
+}
+
+// WithFS sets the file system that files are read from.
+func WithFS(fs FileSystem) Option {
+	return func(p *Parser) { p.FS = fs }
+}
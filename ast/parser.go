@@ -5,17 +5,25 @@
 package ast
 
 import (
+	"crypto/sha256"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/goulash/lex"
 )
 
 var (
 	ErrMaxDepthExceeded = errors.New("maximum include depth exceeded")
+	ErrSafeMode         = errors.New("file access is disabled in safe mode")
+	ErrBudgetExceeded   = errors.New("maximum number of parse steps exceeded")
+	ErrOutputExceeded   = errors.New("maximum output size exceeded")
 
 	errRequireIgnore = errors.New("ignoring file because already read")
 )
@@ -23,20 +31,263 @@ var (
 type Error struct {
 	Err     error
 	PosInfo PosInfo
+
+	// Includes are the positions of the include commands through which
+	// the file at PosInfo was included, innermost first.
+	Includes []PosInfo
 }
 
+// Error returns the error with its position and the chain of includes
+// that led to it, as in
+//
+//  b.txt:2:10: unknown command foo, included from a.txt:10:2, from root.txt:3:2
+//
 func (e *Error) Error() string {
-	return fmt.Sprintf("%s: %v", e.PosInfo, e.Err)
+	s := fmt.Sprintf("%s: %v", e.PosInfo, e.Err)
+	for i, pi := range e.Includes {
+		if i == 0 {
+			s += ", included from " + pi.String()
+		} else {
+			s += ", from " + pi.String()
+		}
+	}
+	return s
 }
 
+// Unwrap returns Err, so that errors.Is and errors.As see through e.
+func (e *Error) Unwrap() error { return e.Err }
+
 type Parser struct {
 	Trigger         string
 	Commenters      Commenters
 	MaxIncludeDepth int
 
+	// If MaxTokenSize is greater than zero, text is split into nodes of at
+	// most MaxTokenSize bytes, and longer comments are an error.
+	MaxTokenSize int
+
+	// If MaxSteps is greater than zero, parsing fails with ErrBudgetExceeded
+	// after MaxSteps steps, of which roughly one is taken per token.
+	MaxSteps int
+
+	// If MaxOutputSize is greater than zero, parsing fails with
+	// ErrOutputExceeded once the output is larger than MaxOutputSize bytes.
+	// If MaxExpansion is greater than zero, the same happens once the output
+	// is more than MaxExpansion times as large as the input, which is all
+	// distinct files read. Both protect against output that grows
+	// exponentially, such as from files that include each other repeatedly.
+	MaxOutputSize int
+	MaxExpansion  int
+
+	// If KeepDirectives is true, directives with unknown commands are not
+	// an error, but are output verbatim, as are define directives and
+	// includes of the form #include <file>.
+	KeepDirectives bool
+
+	// If KeepPragmas is true as well as KeepDirectives, pragma commands are
+	// output verbatim instead of being run, so that their options take
+	// effect only when the output is parsed.
+	KeepPragmas bool
+
+	// IncludePaths are searched in order for files included with the syntax
+	// of the C preprocessor, #include <file>. If IncludePaths is empty, such
+	// directives are kept verbatim if KeepDirectives is true, and are an
+	// error otherwise.
+	IncludePaths []string
+
+	// If LineContinuation is true, a backslash at the end of a line inside
+	// a directive continues the directive on the next line.
+	LineContinuation bool
+
+	// If Builtins is true, __FILE__ and __LINE__ in the text are replaced
+	// by the quoted name of the file and the current line number, and
+	// __BASENAME__ and __EXT__ by the name of the root file without its
+	// directory and its extension without the dot, such as main.go and go.
+	// The latter two are the same in all included files, so that these can
+	// adapt to the kind of file they are included into.
+	Builtins bool
+
+	// If PlatformBuiltins is true, __GOOS__ and __GOARCH__ in the text are
+	// replaced by the operating system and architecture that the parser runs
+	// on, as in runtime.GOOS and runtime.GOARCH, and __HOSTNAME__ and
+	// __USER__ by the names of the host and of the user. They are replaced
+	// like the other builtins, but independently of Builtins, and never in
+	// SafeMode.
+	PlatformBuiltins bool
+
+	// Symbols are replaced by their values wherever their names occur in
+	// the text as entire identifiers, like the builtins. Unlike these,
+	// they are replaced even if Builtins is false.
+	Symbols map[string]string
+
+	// If SafeMode is true, commands that access the file system fail
+	// with ErrSafeMode.
+	SafeMode bool
+
+	// If IgnoreCase is true, command names are matched case-insensitively.
+	IgnoreCase bool
+
+	// Aliases maps alternative command names to the commands they stand for.
+	// If IgnoreCase is true, the alternative names must be in lower case.
+	Aliases map[string]string
+
+	// If EscapeTrigger is true, a doubled trigger at the beginning of a line
+	// is replaced by a single trigger and the line is treated as text.
+	EscapeTrigger bool
+
+	// Quotes are the runes that begin and end string literals in the text.
+	// Comment markers inside string literals are not recognized.
+	Quotes string
+
+	// Quoting decides how strings in directives are quoted and escaped.
+	// If it is nil, DefaultQuoting is used.
+	Quoting *Quoting
+
+	// If TabWidth is greater than zero, columns are counted in runes instead
+	// of bytes, and tabs advance the column to the next multiple of TabWidth.
+	TabWidth int
+
+	// If RequireByContent is true, require deduplicates files by the hash of
+	// their content instead of by their resolved path.
+	RequireByContent bool
+
+	// If FoldCase is true, require compares the resolved paths of files
+	// case-insensitively, as is right on case-insensitive file systems.
+	FoldCase bool
+
+	// If HeaderLines is greater than zero, a block of comments at the
+	// beginning of the root file, starting within the first HeaderLines
+	// lines, is removed and replaced by Header, which may be empty.
+	HeaderLines int
+	Header      string
+
+	// Defines are macros that are defined before the root file is parsed.
+	Defines []Macro
+
+	// Redefine decides what happens when a macro is defined again with a
+	// different value. The default is RedefineLast.
+	Redefine Redefinition
+
+	// Binary decides what happens to files that are binary, which are
+	// not lexed. The default is BinaryError.
+	Binary BinaryPolicy
+
+	// Transformers convert the content of files included with the via
+	// keyword before it is parsed, such as #include "data.csv" via csv2md.
+	Transformers map[string]func([]byte) ([]byte, error)
+
+	// IncludeMap binds logical names in include commands, such as
+	// "stdlib/strings", to the paths of actual files. Keys that end in a
+	// slash bind every name that begins with them, so that "stdlib/" can
+	// be bound to a directory. Names that are not in IncludeMap are paths
+	// relative to the including file, as usual.
+	IncludeMap map[string]string
+
+	// Fragments are named snippets that are included like files, with the
+	// name in angle brackets, such as #include "<prelude>". They are not
+	// read from the file system, and are also available in SafeMode.
+	Fragments map[string]string
+
+	// IncludeDirs makes including a directory include the files in it in
+	// sorted order, but not those in its subdirectories. Otherwise this
+	// fails with ErrIsDir. If FS is set, it must be a DirFileSystem.
+	IncludeDirs bool
+
+	// Validate makes the parser only check the files: commands are run as
+	// usual, but text and comments are not added to the tree, which then
+	// only consists of file nodes.
+	Validate bool
+
+	// StrictUTF8 makes files that are not valid UTF-8 an error, which is
+	// ErrInvalidUTF8 at the position of the first invalid byte, even if
+	// Binary is BinaryPassthrough.
+	StrictUTF8 bool
+
+	// If ResourceCache is not nil, files in archives are read through it,
+	// so that each is only extracted once. It is not used if FS is set.
+	ResourceCache ResourceCache
+
+	// If Fates is true, what becomes of each part of the source is recorded,
+	// so that FileNode.Fate can tell. This costs memory for every token.
+	Fates bool
+
+	// If Stats is not nil, the time spent on each file is added to it.
+	Stats *Stats
+
+	// If Metrics is not nil, every command that is run is counted in it,
+	// like those passed to OnCommand.
+	Metrics *Metrics
+
+	// If RequireCache is not nil, the trees of required files are shared
+	// through it with other parsers, so that they are only parsed once.
+	RequireCache *RequireCache
+
+	// FS is the file system that files are read from. If it is nil, it is
+	// that of the operating system, OSFileSystem.
+	FS FileSystem
+
+	// If Index is not nil, every file that is included or required is
+	// recorded in it, together with the position of the command.
+	Index *Index
+
+	// If Graph is not nil, every file that is read and every include or
+	// require command is recorded in it.
+	Graph *Graph
+
+	// If Mmap is true, files are mapped into memory instead of being read,
+	// where the system supports it, so that they are backed by the page
+	// cache instead of the heap. The tree then refers to the mapped memory,
+	// which must be released with Close once the tree is no longer used.
+	// Mmap has no effect if FS is set.
+	Mmap bool
+
+	// If NameBase is not empty, the names of files in positions are relative
+	// to the directory NameBase where possible. If SlashNames is true, they
+	// use forward slashes as separators on all systems. The names that files
+	// are read by are not affected.
+	NameBase   string
+	SlashNames bool
+
+	// OnMessage is called with the argument of each message command and its
+	// position. If it is nil, messages are reported as diagnostics.
+	OnMessage func(pi PosInfo, msg string)
+
+	// OnCommand is called with each command that pre runs, such as include
+	// or define, and its parsed arguments, before it is run. It is not called
+	// for directives that are kept verbatim, which pre does not parse.
+	OnCommand func(c Command)
+
+	// If Sink is not nil, diagnostics are passed to it as they occur,
+	// instead of being collected for Diagnostics.
+	Sink DiagnosticsSink
+
+	// Symlinks decides how symbolic links in the paths of files are
+	// treated. The default is SymlinksFollow.
+	Symlinks SymlinkPolicy
+
 	nod          *FileNode
-	files        map[string]bool // included file paths
-	includeDepth int             // include depth
+	src          string           // source of the file being parsed
+	lines        lineIndex        // lines of src, see line
+	files        map[string]bool  // included file paths
+	required     []string         // keys of files, in the order they were required
+	skipped      int              // number of requires of files already read
+	defs         map[string]Macro // defined macros
+	diags        []Diagnostic     // diagnostics that occurred
+	rootDir      string           // resolved directory of the root file
+	stops        string           // runes at which lexText stops, see stopRunes
+	mapped       [][]byte         // memory maps of files, see Mmap
+	hdr          *headerState     // header of the root file, if pending
+	prag         pragmaState      // options set by the pragma command
+	includeDepth int              // include depth
+	steps        int              // parse steps taken
+	inputs       map[string]bool  // files counted in inSize
+	inSize       int              // size of the input, see MaxExpansion
+	outSize      int              // size of the output so far
+	nested       time.Duration    // time spent on files included by the current file
+	failed       *int32           // set once parsing failed, so that lexers stop
+	commentEnds  *sync.Map        // ends of comment directives, see commentDirectiveEnd
+	missing      []string         // files looked for but not found, see Missing
+	dirs         []string         // directories included, see Dirs
 }
 
 // Root returns the root node in the AST.
@@ -44,91 +295,274 @@ func (p *Parser) Root() *FileNode {
 	return p.nod
 }
 
+// Missing returns the absolute paths of the files that were looked for
+// while parsing but did not exist, such as alternatives that were passed
+// over, in order. Creating one of them can change the output.
+func (p *Parser) Missing() []string {
+	return p.missing
+}
+
+// Dirs returns the absolute paths of the directories that were included
+// with IncludeDirs, in order. Adding files to them can change the output.
+func (p *Parser) Dirs() []string {
+	return p.dirs
+}
+
 // Parse parses a file and returns an error if one occurs.
 func (p *Parser) Parse(path string) error {
-	return p.parseFile(path, PosInfo{Name: path}, true)
+	p.failed, p.commentEnds = new(int32), new(sync.Map)
+	if err := p.predefine(); err != nil {
+		return err
+	}
+	return p.parseFile(path, PosInfo{Name: p.DisplayName(path)}, true, "", "")
 }
 
 // ParseString parses a string as the root node.
 func (p *Parser) ParseString(name, code string) (err error) {
+	p.failed, p.commentEnds = new(int32), new(sync.Map)
 	p.nod = &FileNode{
-		PosInfo: PosInfo{Name: name},
+		PosInfo: PosInfo{Name: p.DisplayName(name)},
 		name:    name,
 		path:    "",
+		src:     code,
+		fates:   p.Fates,
 		root:    nil,
 	}
-	r := lex.NewReader(lex.Lex(name, string(code), p.lexText))
-	for fn := p.parseNext; fn != nil; {
-		fn, err = fn(r)
-		if err != nil && err != errRequireIgnore {
-			break
+	if p.Fates {
+		p.nod.lines = indexLines(code)
+	}
+	p.src, p.lines = code, p.nod.lines
+	p.rootDir = resolveIn(p.fs(), filepath.Dir(name))
+	p.addInput("", len(code))
+	if err := p.predefine(); err != nil {
+		return err
+	}
+	if p.StrictUTF8 {
+		if err := p.checkUTF8(name, code); err != nil {
+			return err
 		}
 	}
-	if err != nil {
-		err = &Error{err, posInfo(r)}
+	p.beginHeader()
+	p.stopRunes()
+	return p.parseSource(name, code)
+}
+
+// addNode adds n to the current node and counts its size as output.
+func (p *Parser) addNode(n Node) {
+	if p.Validate {
+		return
+	}
+	p.outSize += n.Len()
+	p.nod.addNode(n)
+}
+
+// addInput counts the size of the file at path as input, once per path.
+func (p *Parser) addInput(path string, size int) {
+	if p.inputs == nil {
+		p.inputs = make(map[string]bool)
+	}
+	if !p.inputs[path] {
+		p.inputs[path] = true
+		p.inSize += size
 	}
-	return
+}
+
+// checkOutput returns an error if the output exceeds MaxOutputSize
+// or MaxExpansion.
+func (p *Parser) checkOutput() error {
+	if p.MaxOutputSize > 0 && p.outSize > p.MaxOutputSize {
+		return fmt.Errorf("%w: %d bytes", ErrOutputExceeded, p.outSize)
+	}
+	if p.MaxExpansion > 0 && p.outSize > p.MaxExpansion*p.inSize {
+		return fmt.Errorf("%w: %d bytes from %d bytes of input", ErrOutputExceeded, p.outSize, p.inSize)
+	}
+	return nil
 }
 
 type parseFn func(*lex.Reader) (parseFn, error)
 
-func (p *Parser) parseFile(name string, pi PosInfo, unique bool) (err error) {
-	if p.includeDepth >= p.MaxIncludeDepth {
+// parseSource parses code, the content of the file name, and adds it to
+// the current node. If parsing fails, the lexers are told to stop and are
+// drained, so that they do not remain blocked and keep code in memory.
+func (p *Parser) parseSource(name, code string) error {
+	l := lex.Lex(p.DisplayName(name), code, p.lexText)
+	err := p.parse(lex.NewReader(l))
+	if err != nil {
+		atomic.StoreInt32(p.failed, 1)
+		l.Drain()
+	}
+	return err
+}
+
+// parse parses everything that r reads and adds it to the current node.
+func (p *Parser) parse(r *lex.Reader) (err error) {
+	for fn := p.parseNext; fn != nil; {
+		if p.MaxSteps > 0 {
+			if p.steps++; p.steps > p.MaxSteps {
+				return &Error{Err: ErrBudgetExceeded, PosInfo: p.posInfo(r)}
+			}
+		}
+		if err := p.checkOutput(); err != nil {
+			return &Error{Err: err, PosInfo: p.posInfo(r)}
+		}
+		fn, err = fn(r)
+		if err != nil && err != errRequireIgnore {
+			if e, ok := err.(*Error); ok {
+				// The error occurred in an included file.
+				e.Includes = append(e.Includes, p.posInfo(r))
+				return e
+			}
+			return &Error{Err: err, PosInfo: p.posInfo(r)}
+		}
+	}
+	return nil
+}
+
+// parseFile parses the file name and adds it to the current node.
+// If sum is not empty, the SHA-256 digest of the file must match it.
+// If via is not empty, the file is converted by that transformer first.
+func (p *Parser) parseFile(name string, pi PosInfo, unique bool, sum, via string) (err error) {
+	if p.includeDepth >= p.maxIncludeDepth() {
 		return ErrMaxDepthExceeded
 	}
 
-	bs, err := ioutil.ReadFile(name)
+	start, nested := time.Now(), p.nested
+	var path string
+	var read time.Duration
+	if p.Stats != nil {
+		p.nested = 0
+		defer func() { p.timeFile(path, start, read, nested) }()
+	}
+	bs, code, err := p.readSource(name)
+	read = time.Since(start)
 	if err != nil {
+		if names, derr := p.readDir(name); derr == nil {
+			return p.parseDir(name, names, pi, unique, sum, via)
+		}
 		return err
 	}
-	abs, err := filepath.Abs(name)
-	if err != nil {
-		// TODO: should I do this?
-		fmt.Fprintln(os.Stderr, "Warning:", err)
-		abs = name
+	if sum != "" {
+		if got := fmt.Sprintf("%x", sha256.Sum256(bs)); got != sum {
+			return fmt.Errorf("checksum mismatch for %s: expected sha256 %s, got %s", name, sum, got)
+		}
+	}
+	if via != "" {
+		if bs, err = p.Transformers[via](bs); err != nil {
+			return fmt.Errorf("transformer %s: %v", via, err)
+		}
+		code = string(bs)
+	}
+	if p.StrictUTF8 {
+		if err := p.checkUTF8(name, code); err != nil {
+			return err
+		}
+	}
+	binary := isBinary(bs)
+	if binary && p.Binary != BinaryPassthrough {
+		return fmt.Errorf("%s: %w", name, ErrBinary)
 	}
-	path, err := filepath.EvalSymlinks(abs)
+	archive, file := splitArchive(name)
+	path, err = p.resolvePath(archive, pi)
 	if err != nil {
-		// TODO: should I do this?
-		fmt.Fprintln(os.Stderr, "Warning:", err)
-		path = abs
+		return err
+	}
+	if p.nod == nil {
+		p.rootDir = filepath.Dir(path)
+	}
+	if file != "" {
+		path += archiveSep + file
+	}
+	p.addInput(path, len(code))
+
+	// Only files that are included from another file are referenced.
+	if p.Index != nil && p.nod != nil {
+		p.Index.add(path, pi, p.nod.path)
+	}
+	if p.Graph != nil {
+		if p.nod == nil {
+			p.Graph.addFile(path)
+		} else {
+			kind := "include"
+			if unique {
+				kind = "require"
+			}
+			p.Graph.addEdge(Edge{p.nod.id(), path, kind, pi})
+		}
 	}
 
-	// Note: this is currently best-effort. If same files are
-	// mounted in different places, we will not catch it. But
-	// then again, maybe we should just accept that.
+	// Note: by path this is best-effort. If same files are
+	// mounted in different places, we will not catch it.
+	// That is what RequireByContent is for.
 	if unique {
+		key := path
+		if p.FoldCase {
+			key = strings.ToLower(path)
+		}
+		if p.RequireByContent {
+			key = fmt.Sprintf("sha256:%x", sha256.Sum256(bs))
+		}
 		if p.files == nil {
 			p.files = make(map[string]bool)
-		} else if p.files[path] {
+		} else if p.files[key] {
 			// We already read this file, ignore it.
+			p.skipped++
 			return errRequireIgnore
 		}
-		p.files[path] = true
+		p.files[key] = true
+		p.required = append(p.required, key)
+	}
+	share := unique && !binary && p.canShare()
+	if share {
+		if ok, err := p.reuseRequired(path, code, pi); ok {
+			return err
+		}
 	}
 
 	fn := &FileNode{
 		PosInfo: pi,
 		name:    name,
 		path:    path,
+		src:     code,
+		fates:   p.Fates,
 		root:    p.nod,
 	}
+	if p.Fates {
+		fn.lines = indexLines(code)
+	}
 	if p.nod != nil {
 		p.nod.addNode(fn)
 	}
+	if binary {
+		// Binary files are output as they are, without being lexed.
+		fn.addNode(&TextNode{PosInfo{p.DisplayName(name), 1, 1}, code, code})
+		if p.Fates {
+			fn.spans = []span{{0, len(code), FateEmitted}}
+		}
+		p.outSize += len(code)
+		if p.nod == nil {
+			p.nod = fn
+		}
+		return nil
+	}
 	p.nod = fn
 	p.includeDepth++
-	r := lex.NewReader(lex.Lex(name, string(bs), p.lexText))
-	for fn := p.parseNext; fn != nil; {
-		fn, err = fn(r)
-		if err != nil && err != errRequireIgnore {
-			break
-		}
+	src, lines := p.src, p.lines
+	p.src, p.lines = code, fn.lines
+	if fn.root == nil {
+		p.beginHeader()
 	}
-	if err != nil {
-		err = &Error{err, posInfo(r)}
+	prag := p.prag
+	var before shareState
+	if share {
+		before = p.shareState()
 	}
+	p.stopRunes()
+	err = p.parseSource(name, p.src)
+	p.src, p.lines, p.prag = src, lines, prag
 	p.includeDepth--
+	if share && err == nil {
+		p.putRequired(fn, before)
+	}
 	if p.nod.root != nil {
 		p.nod = p.nod.root
 	}
@@ -144,33 +578,54 @@ func (p *Parser) parseNext(r *lex.Reader) (parseFn, error) {
 		return p.parseComment, nil
 	case typeActionBegin:
 		return p.parseAction, nil
+	case typeBuiltin:
+		return p.parseBuiltin, nil
 	case lex.TypeError:
 		return nil, errors.New(tok.Value)
 	case lex.TypeEOF:
+		p.endHeader("", "", PosInfo{})
 		return nil, nil
 	default:
-		// TODO: what kind of token was unexpected?
-		return nil, errors.New("unexpected token")
+		return nil, fmt.Errorf("unexpected %s", TokenType(tok.Type))
 	}
 }
 
 func (p *Parser) parseText(r *lex.Reader) (parseFn, error) {
 	t := r.Next()
-	p.nod.addNode(&TextNode{posInfo(r), t.Value})
+	pi := p.posInfo(r)
+	p.record(t.Pos, t.Value, FateEmitted)
+	if !p.headerText(t.Value, t.Value, pi) {
+		p.addNode(&TextNode{pi, t.Value, t.Value})
+	}
 	return p.parseNext, nil
 }
 
 func (p *Parser) parseComment(r *lex.Reader) (parseFn, error) {
 	t := r.Next()
-	p.nod.addNode(&CommentNode{posInfo(r), t.Value, p.Commenters.First(t.Value)})
+	pi := p.posInfo(r)
+	c := p.Commenters.FirstAt(t.Value, pi.Column == 1)
+	if c == nil {
+		// The lexer only emits comments that begin with a commenter.
+		return nil, fmt.Errorf("unexpected comment %q", t.Value)
+	}
+	if !p.headerComment(pi) && !p.strip(c) {
+		s := t.Value
+		if c.Expand {
+			s = p.expandComment(s, pi)
+		}
+		p.record(t.Pos, t.Value, FateEmitted)
+		p.addNode(&CommentNode{pi, s, t.Value, c})
+	} else {
+		p.record(t.Pos, t.Value, FateStripped)
+	}
 	return p.parseNext, nil
 }
 
 func (p *Parser) parseShebang(r *lex.Reader) (parseFn, error) {
-	_, ok := r.Expect(typeExclamation, typeSlash)
-	pi := posInfo(r)
+	toks, ok := r.Expect(typeExclamation, typeSlash)
+	pi := p.posInfo(r)
 	if !ok {
-		return nil, errors.New("shebang paths are absolute, expecting slash '/'")
+		return nil, expectError(toks, "shebang paths are absolute, expecting slash '/'")
 	}
 
 	if pi.Line != 1 {
@@ -188,6 +643,7 @@ func (p *Parser) parseShebang(r *lex.Reader) (parseFn, error) {
 
 func (p *Parser) parseAction(r *lex.Reader) (parseFn, error) {
 	r.Next() // trigger token
+	p.endHeader("", "", PosInfo{})
 
 	// If the token afterwards is !, then it could be something like #!/usr/bin/env
 	if r.Peek().Type == typeExclamation {
@@ -195,55 +651,374 @@ func (p *Parser) parseAction(r *lex.Reader) (parseFn, error) {
 	}
 
 	tok := r.Next()
+	pi := p.posInfo(r)
 	if tok.Type != typeIdent {
+		if p.KeepDirectives {
+			return p.keepDirective(r, pi, tok)
+		}
 		return nil, errors.New("expecting command identifier")
 	}
 
-	switch cmd := tok.Value; cmd {
+	cmd := p.command(tok.Value)
+	if (cmd == "include" || cmd == "require") && r.Peek().Type == typeRaw {
+		// Such as #include <stdio.h>, as for the C preprocessor.
+		if len(p.IncludePaths) > 0 && isAngled(r.Peek().Value) {
+			return p.parseSystemInclude(r, cmd == "require")
+		}
+		if p.KeepDirectives {
+			return p.keepDirective(r, pi, tok)
+		}
+	}
+
+	switch cmd {
 	case "include":
+		if r.Peek().Type == typeQuestion {
+			r.Next()
+			return p.parseCmdIncludeOptional, nil
+		}
 		return p.parseCmdInclude, nil
 	case "require":
 		return p.parseCmdRequire, nil
+	case "define":
+		return p.parseCmdDefine, nil
 	case "error":
 		return p.parseCmdError, nil
+	case "message":
+		return p.parseCmdMessage, nil
+	case "process":
+		return p.parseCmdProcess, nil
+	case "pragma":
+		if p.KeepDirectives && (p.KeepPragmas || !isPragma(r.Peek())) {
+			// Such as #pragma once, which is for the C preprocessor.
+			return p.keepDirective(r, pi, tok)
+		}
+		return p.parseCmdPragma, nil
 	default:
-		return nil, fmt.Errorf("unknown command %s", cmd)
+		if p.KeepDirectives {
+			return p.keepDirective(r, pi, tok)
+		}
+		return nil, fmt.Errorf("unknown command %s", tok.Value)
 	}
 }
 
-func (p *Parser) parseCmdInclude(r *lex.Reader) (parseFn, error) {
-	pi := posInfo(r)
-	args, ok := r.Expect(typeString, typeActionEnd)
-	if !ok {
-		return nil, errors.New("command include takes a single string argument")
+// keepDirective skips the rest of the directive at pi, of which tok is the
+// last token read, and adds the lines it is on to the tree verbatim.
+func (p *Parser) keepDirective(r *lex.Reader, pi PosInfo, tok lex.Token) (parseFn, error) {
+	for ; tok.Type != typeActionEnd; tok = r.Next() {
+		switch tok.Type {
+		case lex.TypeError:
+			return nil, errors.New(tok.Value)
+		case lex.TypeEOF:
+			return nil, errors.New("unexpected EOF")
+		}
 	}
+	p.addLines(pi, p.posInfo(r).Line)
+	return p.parseNext, nil
+}
 
-	path := filepath.Join(filepath.Dir(p.nod.name), args[0].Value)
-	return p.parseNext, p.parseFile(path, pi, false)
+// addLines adds the lines of the current file from pi up to and including
+// the line last to the tree verbatim.
+func (p *Parser) addLines(pi PosInfo, last int) {
+	pi.Column = 1
+	start, end := p.lineOffset(pi.Line), p.lineOffset(last+1)
+	if start < 0 {
+		return
+	}
+	if end < 0 {
+		end = len(p.src)
+	}
+	s := p.src[start:end]
+	p.record(start, s, FateEmitted)
+	p.addNode(&TextNode{pi, s, s})
+}
+
+// command returns the name of the command that name refers to,
+// taking IgnoreCase and Aliases into account.
+func (p *Parser) command(name string) string {
+	if p.IgnoreCase {
+		name = strings.ToLower(name)
+	}
+	if cmd, ok := p.Aliases[name]; ok {
+		return cmd
+	}
+	return name
+}
+
+func (p *Parser) parseCmdInclude(r *lex.Reader) (parseFn, error) {
+	return p.parseInclude(r, "include", false, false)
+}
+
+// parseCmdIncludeOptional is the same as include, except that a missing file
+// is silently skipped instead of failing the parse.
+func (p *Parser) parseCmdIncludeOptional(r *lex.Reader) (parseFn, error) {
+	return p.parseInclude(r, "include?", false, true)
 }
 
 // this is best effort require at the moment. There are several ways to work around this.
 func (p *Parser) parseCmdRequire(r *lex.Reader) (parseFn, error) {
-	pi := posInfo(r)
-	args, ok := r.Expect(typeString, typeActionEnd)
-	if !ok {
-		return nil, errors.New("command require takes a single string argument")
+	return p.parseInclude(r, "require", true, false)
+}
+
+// parseInclude implements the include-like command cmd. If unique is true,
+// files that have already been read are skipped. If optional is true,
+// a missing file is not an error.
+func (p *Parser) parseInclude(r *lex.Reader, cmd string, unique, optional bool) (parseFn, error) {
+	pi := p.posInfo(r)
+	args, err := p.parseIncludeArgs(r, pi, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	if args.scoped || len(args.params) > 0 {
+		defs := p.Definitions()
+		defer func() { p.defs = defs }()
+	}
+	for _, a := range args.params {
+		p.define(Macro{PosInfo: pi, Name: a.Key, Value: a.Value, Source: SourceParameter})
+	}
+	err = p.parseFirst(args, pi, unique)
+	if (optional || args.optional) && os.IsNotExist(err) {
+		err = nil
+	}
+	return p.parseNext, err
+}
+
+// includeArgs are the arguments of an include-like command.
+type includeArgs struct {
+	// paths are the candidates, relative to the including file.
+	paths []string
+
+	// sha256 is the expected hex digest of the included file, if not empty.
+	sha256 string
+
+	// optional is true if a missing file is not an error.
+	optional bool
+
+	// scoped is true if macros defined by the file are forgotten after it.
+	scoped bool
+
+	// via is the name of the transformer that converts the file, if any.
+	via string
+
+	// params are defined as macros for the included file only.
+	params []Arg
+}
+
+// parseIncludeArgs reads the arguments of an include-like command, which are
+// one or more strings separated by "or", optionally followed by a checksum,
+// the scoped keyword, and key=value arguments:
+//
+//  #include "site.conf" or "defaults.conf"
+//  #require "vendor/snippet.inc" sha256 "ab12..."
+//  #include "fragment.inc" scoped
+//  #include "data.csv" via csv2md
+//  #include "local.conf" optional=true
+//  #include "service.tmpl" NAME="auth" PORT=8080
+//
+// All key=value arguments other than optional are parameters, which are
+// defined as macros inside of the included file, but not after it.
+func (p *Parser) parseIncludeArgs(r *lex.Reader, pi PosInfo, cmd string) (*includeArgs, error) {
+	list, err := p.parseArgs(r)
+	if err != nil {
+		return nil, err
 	}
+	p.onCommand(pi, cmd, list)
 
-	path := filepath.Join(filepath.Dir(p.nod.name), args[0].Value)
-	return p.parseNext, p.parseFile(path, pi, true)
+	var args includeArgs
+	for i := 0; i < len(list); i++ {
+		a := list[i]
+		switch {
+		case a.Key == "optional":
+			if args.optional, err = a.Bool(); err != nil {
+				return nil, err
+			}
+		case a.Key != "":
+			args.params = append(args.params, a)
+		case a.Type == StringArg && len(args.paths) == 0,
+			a.Type == StringArg && list[i-1].Type == IdentArg && list[i-1].Value == "or":
+			path, ok := p.mappedPath(a.Value)
+			if isAngled(a.Value) {
+				path = a.Value
+			} else if !ok {
+				path = includePath(filepath.Dir(p.nod.name), a.Value)
+			}
+			args.paths = append(args.paths, path)
+		case a.Type == IdentArg && a.Value == "or" && len(args.paths) > 0:
+			if i+1 == len(list) || list[i+1].Type != StringArg {
+				return nil, fmt.Errorf("command %s expects a string after or", cmd)
+			}
+		case a.Type == IdentArg && a.Value == "sha256" && len(args.paths) > 0:
+			if i+1 == len(list) || list[i+1].Type != StringArg || list[i+1].Key != "" {
+				return nil, fmt.Errorf("command %s expects a string after sha256", cmd)
+			}
+			i++
+			args.sha256 = strings.ToLower(list[i].Value)
+		case a.Type == IdentArg && a.Value == "scoped" && len(args.paths) > 0:
+			args.scoped = true
+		case a.Type == IdentArg && a.Value == "via" && len(args.paths) > 0:
+			if i+1 == len(list) || list[i+1].Type != IdentArg {
+				return nil, fmt.Errorf("command %s expects a transformer after via", cmd)
+			}
+			i++
+			if _, ok := p.Transformers[list[i].Value]; !ok {
+				return nil, fmt.Errorf("unknown transformer %s", list[i].Value)
+			}
+			args.via = list[i].Value
+		default:
+			return nil, fmt.Errorf("command %s takes one or more string arguments separated by or", cmd)
+		}
+	}
+	if len(args.paths) == 0 {
+		return nil, fmt.Errorf("command %s takes one or more string arguments separated by or", cmd)
+	}
+	return &args, nil
+}
+
+// parseFirst parses the first file in args.paths that exists. If none of them
+// exist, an error is returned that satisfies os.IsNotExist. All commands that
+// read files do so through parseFirst.
+func (p *Parser) parseFirst(args *includeArgs, pi PosInfo, unique bool) (err error) {
+	for _, path := range args.paths {
+		// Fragments do not touch the file system.
+		if p.SafeMode && !isAngled(path) {
+			return ErrSafeMode
+		}
+		err = p.parseFile(path, pi, unique, args.sha256, args.via)
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if !isAngled(path) {
+			p.missing = append(p.missing, resolveIn(p.fs(), path))
+		}
+	}
+	if len(args.paths) > 1 {
+		err = &os.PathError{
+			Op:   "include",
+			Path: strings.Join(args.paths, " or "),
+			Err:  os.ErrNotExist,
+		}
+	}
+	return err
 }
 
 func (p *Parser) parseCmdError(r *lex.Reader) (parseFn, error) {
-	args, ok := r.Expect(typeString, typeActionEnd)
-	if !ok {
-		return nil, errors.New("command error takes a single string argument")
+	pi := p.posInfo(r)
+	msg, err := p.stringArg(r, "command error takes a single string argument")
+	if err != nil {
+		return nil, err
 	}
+	p.onCommand(pi, "error", []Arg{{Type: StringArg, Value: msg}})
+	return nil, &UserError{msg}
+}
 
-	return nil, errors.New(args[0].Value)
+// parseCmdMessage passes its argument to OnMessage, or reports it as
+// a diagnostic if that is nil. It does not affect the output.
+func (p *Parser) parseCmdMessage(r *lex.Reader) (parseFn, error) {
+	pi := p.posInfo(r)
+	msg, err := p.stringArg(r, "command message takes a single string argument")
+	if err != nil {
+		return nil, err
+	}
+	p.onCommand(pi, "message", []Arg{{Type: StringArg, Value: msg}})
+	if p.OnMessage != nil {
+		p.OnMessage(pi, msg)
+	} else {
+		p.diagnose(pi, "message", "%s", msg)
+	}
+	return p.parseNext, nil
+}
+
+// A UserError is the error that the error command fails with.
+type UserError struct {
+	Message string
 }
 
-func posInfo(r *lex.Reader) PosInfo {
+func (e *UserError) Error() string { return e.Message }
+
+// posInfo returns the position of the last token read from r.
+func (p *Parser) posInfo(r *lex.Reader) PosInfo {
 	n, l, c := r.PosInfo()
+	if p.TabWidth > 0 {
+		c = visualColumn(p.line(l), c, p.TabWidth)
+	}
 	return PosInfo{n, l, c}
 }
+
+// line returns the nth line of the file being parsed, starting at 1,
+// without its newline. The lines are only searched for once per file.
+func (p *Parser) line(n int) string {
+	return p.index().line(p.src, n)
+}
+
+// lineOffset returns the offset of the nth line of the file being parsed,
+// starting at 1, or -1 if there is no such line.
+func (p *Parser) lineOffset(n int) int {
+	return p.index().offset(n)
+}
+
+// index returns the lineIndex of the file being parsed.
+func (p *Parser) index() lineIndex {
+	if p.lines == nil {
+		p.lines = indexLines(p.src)
+	}
+	return p.lines
+}
+
+// A lineIndex holds the offsets at which the lines of a source begin.
+type lineIndex []int
+
+// indexLines returns the lineIndex of src.
+func indexLines(src string) lineIndex {
+	ix := lineIndex{0}
+	for i := 0; i < len(src); i++ {
+		if src[i] == '\n' {
+			ix = append(ix, i+1)
+		}
+	}
+	return ix
+}
+
+// offset returns the offset of the nth line, starting at 1, or -1 if there
+// is no such line.
+func (ix lineIndex) offset(n int) int {
+	if n < 1 || n > len(ix) {
+		return -1
+	}
+	return ix[n-1]
+}
+
+// line returns the nth line of src, starting at 1, without its newline.
+func (ix lineIndex) line(src string, n int) string {
+	off := ix.offset(n)
+	if off < 0 {
+		return ""
+	}
+	end := len(src)
+	if n < len(ix) {
+		end = ix[n] - 1
+	}
+	return src[off:end]
+}
+
+// lineAt returns the line, starting at 1, that the offset off is in.
+func (ix lineIndex) lineAt(off int) int {
+	return sort.Search(len(ix), func(i int) bool { return ix[i] > off })
+}
+
+// visualColumn converts the byte column col in line to the column that an
+// editor would show, where each rune takes one column and tabs advance to
+// the next multiple of width.
+func visualColumn(line string, col, width int) int {
+	var v int
+	for i, r := range line {
+		if i >= col-1 {
+			break
+		}
+		if r == '\t' {
+			v += width - v%width
+		} else {
+			v++
+		}
+	}
+	return v + 1
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrSymlinkEscape is returned for a symbolic link that leads out of the
+// directory of the root file if Symlinks is SymlinksConfined.
+var ErrSymlinkEscape = errors.New("symbolic link leads out of the root directory")
+
+// A SymlinkPolicy decides how symbolic links in the paths of files are
+// treated.
+type SymlinkPolicy int
+
+const (
+	// SymlinksFollow evaluates symbolic links, so that files are known by
+	// their real paths. A file is the same for require no matter through
+	// which link it is included.
+	SymlinksFollow SymlinkPolicy = iota
+
+	// SymlinksKeep does not evaluate symbolic links, so that files are known
+	// by the absolute paths they are included by.
+	SymlinksKeep
+
+	// SymlinksConfined is like SymlinksFollow, except that a symbolic link
+	// leading out of the directory of the root file is an error.
+	SymlinksConfined
+)
+
+// resolvePath returns the absolute path of the file name, with symbolic
+// links evaluated according to Symlinks. Paths that cannot be resolved are
+// reported as diagnostics at pi, and used as they are.
+func (p *Parser) resolvePath(name string, pi PosInfo) (string, error) {
+	if isAngled(name) {
+		return name, nil
+	}
+	abs, err := p.fs().Abs(name)
+	if err != nil {
+		p.diagnose(pi, "unresolved-path", "cannot make %s absolute: %v", name, err)
+		abs = name
+	}
+	if p.Symlinks == SymlinksKeep {
+		return abs, nil
+	}
+	path, err := p.fs().EvalSymlinks(abs)
+	if err != nil {
+		p.diagnose(pi, "unresolved-path", "cannot evaluate symbolic links in %s: %v", abs, err)
+		return abs, nil
+	}
+	if p.Symlinks == SymlinksConfined && path != abs && p.rootDir != "" && !inDir(p.rootDir, path) {
+		return "", fmt.Errorf("%s: %w", name, ErrSymlinkEscape)
+	}
+	return path, nil
+}
+
+// inDir returns true if path is inside of the directory dir.
+func inDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// mappedPath returns the path that the logical name is bound to by
+// IncludeMap, and true, or false if name is not in it. A key that ends
+// in a slash binds all names that begin with it, with the rest of the
+// name appended to the path it maps to. The longest key wins.
+func (p *Parser) mappedPath(name string) (string, bool) {
+	if path, ok := p.IncludeMap[name]; ok {
+		return filepath.FromSlash(path), true
+	}
+	var key string
+	for k := range p.IncludeMap {
+		if strings.HasSuffix(k, "/") && strings.HasPrefix(name, k) && len(k) > len(key) {
+			key = k
+		}
+	}
+	if key == "" {
+		return "", false
+	}
+	return filepath.Join(filepath.FromSlash(p.IncludeMap[key]), filepath.FromSlash(name[len(key):])), true
+}
+
+// includePath returns the path of the file name given in an include
+// command in a file in the directory dir. Relative paths are relative to
+// dir, and absolute paths, including those with a drive letter or of a
+// UNC share on Windows, are used as they are. A path that begins with a
+// separator but has no volume name on Windows is on the volume of dir.
+// Forward slashes are accepted as separators on all systems.
+func includePath(dir, name string) string {
+	name = filepath.FromSlash(name)
+	switch {
+	case filepath.IsAbs(name):
+		return filepath.Clean(name)
+	case filepath.VolumeName(name) != "":
+		// Such as C:file, which is relative to the current directory of C:.
+		return name
+	case strings.HasPrefix(name, string(os.PathSeparator)):
+		return filepath.VolumeName(dir) + filepath.Clean(name)
+	default:
+		return filepath.Join(dir, name)
+	}
+}
+
+// DisplayName returns the name of the file name in positions, according to
+// NameBase and SlashNames.
+func (p *Parser) DisplayName(name string) string {
+	if p.NameBase != "" && !isAngled(name) {
+		base, err := p.fs().Abs(p.NameBase)
+		if err == nil {
+			if abs, err := p.fs().Abs(name); err == nil {
+				if rel, err := filepath.Rel(base, abs); err == nil {
+					name = rel
+				}
+			}
+		}
+	}
+	if p.SlashNames {
+		name = filepath.ToSlash(name)
+	}
+	return name
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import (
+	"fmt"
+
+	"github.com/goulash/lex"
+)
+
+// pragmaState holds the options set by the pragma command. They apply to
+// the remainder of the file and the files it includes, and are restored
+// when the file ends.
+type pragmaState struct {
+	strip    *bool // overrides Commenter.Strip, if not nil
+	maxDepth int   // lowers MaxIncludeDepth, if greater than zero
+}
+
+// Version is the version of the language that the parser understands.
+// Files can declare the version they need with the pragma command.
+const Version = 1
+
+// pragmas are the names understood by the pragma command.
+var pragmas = map[string]func(p *Parser, a Arg) error{
+	"strip-comments": (*Parser).pragmaStripComments,
+	"max-depth":      (*Parser).pragmaMaxDepth,
+	"pre":            (*Parser).pragmaVersion,
+	"requires":       (*Parser).pragmaRequires,
+}
+
+// features are the optional features that a file can require with the
+// pragma command, and whether they are enabled.
+var features = map[string]func(p *Parser) bool{
+	"builtins":          func(p *Parser) bool { return p.Builtins },
+	"platform-builtins": func(p *Parser) bool { return p.platform() },
+	"escape-trigger":    func(p *Parser) bool { return p.EscapeTrigger },
+	"ignore-case":       func(p *Parser) bool { return p.IgnoreCase },
+	"keep-directives":   func(p *Parser) bool { return p.KeepDirectives },
+	"line-continuation": func(p *Parser) bool { return p.LineContinuation },
+	"file-access":       func(p *Parser) bool { return !p.SafeMode },
+}
+
+// isPragma returns true if tok is the name of a pragma that pre understands.
+func isPragma(tok lex.Token) bool {
+	_, ok := pragmas[tok.Value]
+	return tok.Type == typeIdent && ok
+}
+
+// parseCmdPragma sets an option for the remainder of the file, or checks
+// that the parser can process the file:
+//
+//  #pragma strip-comments off
+//  #pragma max-depth 16
+//  #pragma pre 1
+//  #pragma requires builtins
+//
+// The first strips or keeps all comments, regardless of their Commenter.
+// The second lowers the maximum include depth; it cannot raise it.
+// The third fails if the file needs a later Version of the language, and
+// the fourth if the feature it names is not enabled.
+func (p *Parser) parseCmdPragma(r *lex.Reader) (parseFn, error) {
+	pi := p.posInfo(r)
+	tok := r.Next()
+	if tok.Type != typeIdent {
+		return nil, fmt.Errorf("command pragma expects a name")
+	}
+	fn, ok := pragmas[tok.Value]
+	if !ok {
+		return nil, fmt.Errorf("unknown pragma %s", tok.Value)
+	}
+	args, err := p.parseArgs(r)
+	if err != nil {
+		return nil, err
+	}
+	p.onCommand(pi, "pragma", append([]Arg{{Type: IdentArg, Value: tok.Value}}, args...))
+	if len(args) != 1 || args[0].Key != "" {
+		return nil, fmt.Errorf("pragma %s takes a single argument", tok.Value)
+	}
+	if err := fn(p, args[0]); err != nil {
+		return nil, fmt.Errorf("pragma %s: %v", tok.Value, err)
+	}
+	return p.parseNext, nil
+}
+
+func (p *Parser) pragmaStripComments(a Arg) error {
+	var strip bool
+	switch {
+	case a.Type == IdentArg && (a.Value == "on" || a.Value == "off"):
+		strip = a.Value == "on"
+	case a.Type == BoolArg:
+		strip, _ = a.Bool()
+	default:
+		return fmt.Errorf("expecting on or off, got %s", a)
+	}
+	p.prag.strip = &strip
+	return nil
+}
+
+func (p *Parser) pragmaMaxDepth(a Arg) error {
+	n, err := a.Int()
+	if err != nil || n <= 0 {
+		return fmt.Errorf("expecting a positive integer, got %s", a)
+	}
+	if n < p.maxIncludeDepth() {
+		p.prag.maxDepth = n
+	}
+	return nil
+}
+
+func (p *Parser) pragmaVersion(a Arg) error {
+	n, err := a.Int()
+	if err != nil || n <= 0 {
+		return fmt.Errorf("expecting a version number, got %s", a)
+	}
+	if n > Version {
+		return fmt.Errorf("file requires version %d of the language, but this is version %d", n, Version)
+	}
+	return nil
+}
+
+func (p *Parser) pragmaRequires(a Arg) error {
+	if a.Type != IdentArg {
+		return fmt.Errorf("expecting a feature, got %s", a)
+	}
+	enabled, ok := features[a.Value]
+	if !ok {
+		return fmt.Errorf("file requires unknown feature %s", a.Value)
+	}
+	if !enabled(p) {
+		return fmt.Errorf("file requires feature %s, which is not enabled", a.Value)
+	}
+	return nil
+}
+
+// strip returns true if the comment matched by c should be stripped.
+func (p *Parser) strip(c *Commenter) bool {
+	if p.prag.strip != nil {
+		return *p.prag.strip
+	}
+	return c.Strip
+}
+
+// maxIncludeDepth returns MaxIncludeDepth, as lowered by the pragma command.
+func (p *Parser) maxIncludeDepth() int {
+	if p.prag.maxDepth > 0 {
+		return p.prag.maxDepth
+	}
+	return p.MaxIncludeDepth
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import (
+	"errors"
+	"path/filepath"
+
+	"github.com/goulash/lex"
+)
+
+// parseCmdProcess parses another file with a different trigger or other
+// commenters, and adds its tree as it would for include:
+//
+//  #process "init.sql" with trigger "%" comment "--"
+//  #process "page.html" with comment "<!--" "-->"
+//
+// Comments of the file are kept, unless it strips them with a pragma.
+// Only the settings of the lexer differ; macros, limits, and the files
+// that were required are shared with the processing file.
+func (p *Parser) parseCmdProcess(r *lex.Reader) (parseFn, error) {
+	pi := p.posInfo(r)
+	list, err := p.parseArgs(r)
+	if err != nil {
+		return nil, err
+	}
+	p.onCommand(pi, "process", list)
+	usage := errors.New(`command process takes a string, optionally followed by with and trigger "t" or comment "begin" ["end"]`)
+	if len(list) == 0 || list[0].Type != StringArg || list[0].Key != "" {
+		return nil, usage
+	}
+	if len(list) > 1 && (len(list) == 2 || list[1].Type != IdentArg || list[1].Value != "with") {
+		return nil, usage
+	}
+
+	// The lexer of p may be reading its settings, so c gets the others.
+	c := *p
+	var commenters Commenters
+	for i := 2; i < len(list); i++ {
+		a := list[i]
+		if a.Type != IdentArg || i+1 == len(list) || list[i+1].Type != StringArg || list[i+1].Value == "" {
+			return nil, usage
+		}
+		i++
+		switch a.Value {
+		case "trigger":
+			c.Trigger = list[i].Value
+		case "comment":
+			cm := &Commenter{Begin: list[i].Value}
+			if i+1 < len(list) && list[i+1].Type == StringArg {
+				i++
+				cm.End = list[i].Value
+			}
+			commenters = append(commenters, cm)
+		default:
+			return nil, usage
+		}
+	}
+	if commenters != nil {
+		c.Commenters = commenters
+	}
+	c.stops = ""
+	c.stopRunes()
+
+	name, ok := p.mappedPath(list[0].Value)
+	if isAngled(list[0].Value) {
+		name = list[0].Value
+	} else if !ok {
+		name = includePath(filepath.Dir(p.nod.name), list[0].Value)
+	}
+	err = c.parseFirst(&includeArgs{paths: []string{name}}, pi, false)
+	p.takeState(&c)
+	return p.parseNext, err
+}
+
+// takeState takes the state of the parser c, which is a copy of p with
+// other settings, after it parsed a file. The settings of p are left as
+// they are, since the lexer of p may be reading them.
+func (p *Parser) takeState(c *Parser) {
+	p.files = c.files
+	p.required = c.required
+	p.skipped = c.skipped
+	p.defs = c.defs
+	p.diags = c.diags
+	p.mapped = c.mapped
+	p.steps = c.steps
+	p.inputs = c.inputs
+	p.inSize = c.inSize
+	p.outSize = c.outSize
+	p.nested = c.nested
+	p.missing = c.missing
+	p.dirs = c.dirs
+}
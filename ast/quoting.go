@@ -0,0 +1,105 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/goulash/lex"
+)
+
+// A Quoting decides how strings in directives are delimited and what their
+// values are, since different formats need different rules, such as for
+// Windows paths, regular expressions, or JSON.
+type Quoting struct {
+	// Quotes are the runes that strings may be quoted with. A string ends
+	// with the same rune that it begins with.
+	Quotes string
+
+	// Escape is the rune that makes the rune following it part of the
+	// string, even if it is a quote, or 0 if there is none.
+	Escape rune
+
+	// Unescape returns the value of a string, given the text between its
+	// quotes. If it is nil, the value is the text as it is. Triple-quoted
+	// strings are never unescaped.
+	Unescape func(s string) (string, error) `json:"-"`
+}
+
+var (
+	// DefaultQuoting is used if Parser.Quoting is nil. Strings are
+	// double-quoted, and a backslash escapes the rune after it, but stays
+	// part of the value, so that "C:\dir" is the path it appears to be.
+	DefaultQuoting = &Quoting{Quotes: `"`, Escape: '\\'}
+
+	// RawQuoting has no escapes at all, which suits Windows paths and
+	// regular expressions. Strings may be quoted with " or ', so that
+	// either quote can be part of a string.
+	RawQuoting = &Quoting{Quotes: `"'`}
+
+	// GoQuoting interprets the escapes of Go string literals, such as \n,
+	// \t, and \u00e9.
+	GoQuoting = &Quoting{Quotes: `"`, Escape: '\\', Unescape: unquoteGo}
+
+	// JSONQuoting interprets the escapes of JSON strings.
+	JSONQuoting = &Quoting{Quotes: `"`, Escape: '\\', Unescape: unquoteJSON}
+)
+
+func unquoteGo(s string) (string, error) {
+	return strconv.Unquote(`"` + s + `"`)
+}
+
+func unquoteJSON(s string) (string, error) {
+	var v string
+	if err := json.Unmarshal([]byte(`"`+s+`"`), &v); err != nil {
+		return "", err
+	}
+	return v, nil
+}
+
+// quoting returns the Quoting of the parser.
+func (p *Parser) quoting() *Quoting {
+	if p.Quoting == nil {
+		return DefaultQuoting
+	}
+	return p.Quoting
+}
+
+// isQuote returns true if strings in directives may begin with r.
+func (p *Parser) isQuote(r rune) bool {
+	return strings.ContainsRune(p.quoting().Quotes, r)
+}
+
+// stringValue returns the value of the string token tok, which is unescaped
+// by the Quoting, unless it is triple-quoted.
+func (p *Parser) stringValue(tok lex.Token) (string, error) {
+	unescape := p.quoting().Unescape
+	if tok.Type == typeLongString || unescape == nil {
+		return tok.Value, nil
+	}
+	v, err := unescape(tok.Value)
+	if err != nil {
+		return "", fmt.Errorf("invalid escape in string %q: %v", tok.Value, err)
+	}
+	return v, nil
+}
+
+// stringArg reads the single string argument of a command and returns its
+// value, or an error beginning with msg if the command has other arguments.
+func (p *Parser) stringArg(r *lex.Reader, msg string) (string, error) {
+	toks := []lex.Token{r.Next()}
+	if t := toks[0].Type; t == typeString || t == typeLongString {
+		toks = append(toks, r.Next())
+	}
+	if len(toks) < 2 || toks[1].Type != typeActionEnd {
+		return "", expectError(toks, msg)
+	}
+	// The value is copied, since the source may be a mapped file.
+	toks[0].Value = string([]byte(toks[0].Value))
+	return p.stringValue(toks[0])
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import "io"
+
+// Hooks transform the output of the nodes of a tree as it is rendered.
+// Any of the hooks may be nil, in which case the output is unchanged.
+type Hooks struct {
+	// OnText and OnComment return the string to output for a node,
+	// given the string s that would be output otherwise.
+	OnText    func(n *TextNode, s string) string
+	OnComment func(n *CommentNode, s string) string
+
+	// OnFileEnter and OnFileExit return a string to output before and after
+	// the contents of a file, including the root file.
+	OnFileEnter func(fn *FileNode) string
+	OnFileExit  func(fn *FileNode) string
+}
+
+// Render writes the text of fn to w like WriteTo, except that the output of
+// every node is passed through the hooks in h first. If h is nil, Render is
+// the same as WriteTo.
+func (fn FileNode) Render(w io.Writer, h *Hooks) (int64, error) {
+	if h == nil {
+		return fn.WriteTo(w)
+	}
+	return h.render(w, &fn)
+}
+
+func (h *Hooks) render(w io.Writer, fn *FileNode) (int64, error) {
+	var total int64
+	write := func(s string) error {
+		k, err := io.WriteString(w, s)
+		total += int64(k)
+		return err
+	}
+
+	if h.OnFileEnter != nil {
+		if err := write(h.OnFileEnter(fn)); err != nil {
+			return total, err
+		}
+	}
+	for _, n := range fn.nodes {
+		var err error
+		switch n := n.(type) {
+		case *FileNode:
+			var k int64
+			k, err = h.render(w, n)
+			total += k
+		case *TextNode:
+			s := n.val
+			if h.OnText != nil {
+				s = h.OnText(n, s)
+			}
+			err = write(s)
+		case *CommentNode:
+			s := n.val
+			if h.OnComment != nil {
+				s = h.OnComment(n, s)
+			}
+			err = write(s)
+		default:
+			err = write(n.String())
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+	if h.OnFileExit != nil {
+		if err := write(h.OnFileExit(fn)); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
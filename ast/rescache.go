@@ -0,0 +1,108 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A ResourceCache stores content that is expensive to fetch, such as files
+// in archives, by the URL of the content and its etag, which changes
+// whenever the content does. The parser uses it for files in archives,
+// whose URL is archive!/file and whose etag is derived from the size and
+// modification time of the archive, so that each file is only extracted
+// once, instead of once for each command that includes it.
+type ResourceCache interface {
+	// Get returns the content stored for url and etag, and true, or false
+	// if there is none.
+	Get(url, etag string) ([]byte, bool)
+
+	// Put stores data for url and etag.
+	Put(url, etag string, data []byte)
+}
+
+// MemoryCache is a ResourceCache in memory, which may be used by several
+// parsers at once.
+type MemoryCache struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+// NewMemoryCache returns a new, empty MemoryCache.
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{entries: make(map[string][]byte)}
+}
+
+func (c *MemoryCache) Get(url, etag string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	bs, ok := c.entries[url+"\x00"+etag]
+	return bs, ok
+}
+
+func (c *MemoryCache) Put(url, etag string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[url+"\x00"+etag] = data
+}
+
+// DiskCache is a ResourceCache that stores each entry in a file in the
+// directory Dir, so that it survives between runs. Entries whose content
+// changed are not removed, since they are not known to be unused.
+type DiskCache struct {
+	Dir string
+}
+
+func (c DiskCache) path(url, etag string) string {
+	return filepath.Join(c.Dir, fmt.Sprintf("%x", sha256.Sum256([]byte(url+"\x00"+etag))))
+}
+
+func (c DiskCache) Get(url, etag string) ([]byte, bool) {
+	bs, err := ioutil.ReadFile(c.path(url, etag))
+	return bs, err == nil
+}
+
+// Put stores data, or does nothing if that fails, since it can always be
+// fetched again.
+func (c DiskCache) Put(url, etag string, data []byte) {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return
+	}
+	path := c.path(url, etag)
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+	}
+}
+
+// readCached reads the file name, which is in an archive, through the
+// ResourceCache.
+func (p *Parser) readCached(name string) ([]byte, error) {
+	archive, _ := splitArchive(name)
+	fi, err := os.Stat(archive)
+	if err != nil {
+		return nil, err
+	}
+	etag := fmt.Sprintf("%x-%x", fi.Size(), fi.ModTime().UnixNano())
+	url := filepath.ToSlash(name)
+	if bs, ok := p.ResourceCache.Get(url, etag); ok {
+		return bs, nil
+	}
+	bs, err := ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	p.ResourceCache.Put(url, etag, bs)
+	return bs, nil
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import (
+	"sort"
+	"sync"
+)
+
+// A RequireCache shares the trees of required files between parsers, so
+// that a file that many roots require, such as a large common prelude, is
+// only parsed once. A tree is reused only if the file is unchanged, and
+// if parsing it again would lead to the same tree: it must be required
+// where no pragma is in effect, and not have required files that the
+// parser has already read. The macros it defined are defined again, but
+// its diagnostics are not reported again.
+//
+// A RequireCache may be used by several parsers at once, but they must
+// all have the same settings. It is not used if Mmap is true, or if Index
+// or Graph is set.
+type RequireCache struct {
+	mu      sync.Mutex
+	entries map[string]*requireEntry
+}
+
+// requireEntry is the tree of a required file, and what parsing it did.
+type requireEntry struct {
+	node  *FileNode
+	depth int      // include depth at which the file was parsed
+	files []string // keys of the files that it required, see Parser.files
+	defs  []Macro  // macros that it defined
+	steps int      // parse steps that it took
+}
+
+// NewRequireCache returns a new, empty RequireCache.
+func NewRequireCache() *RequireCache {
+	return &RequireCache{entries: make(map[string]*requireEntry)}
+}
+
+func (c *RequireCache) get(key string) *requireEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[key]
+}
+
+func (c *RequireCache) put(key string, e *requireEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = e
+}
+
+// canShare returns true if the tree of the file about to be required can
+// be taken from or put into the RequireCache.
+func (p *Parser) canShare() bool {
+	return p.RequireCache != nil && p.nod != nil && !p.Mmap &&
+		p.Index == nil && p.Graph == nil && p.OnCommand == nil && p.Metrics == nil && p.prag == pragmaState{}
+}
+
+// shareKey returns the key of the file at path in the RequireCache. The
+// builtins __BASENAME__ and __EXT__ depend on the root file.
+func (p *Parser) shareKey(path string) string {
+	if p.Builtins {
+		return path + "\x00" + p.rootName()
+	}
+	return path
+}
+
+// reuseRequired adds the tree of the file at path with the source code
+// at pi from the RequireCache, and returns true, if that is possible.
+func (p *Parser) reuseRequired(path, code string, pi PosInfo) (bool, error) {
+	e := p.RequireCache.get(p.shareKey(path))
+	if e == nil || e.node.src != code || p.includeDepth > e.depth {
+		return false, nil
+	}
+	for _, key := range e.files {
+		if p.files[key] {
+			return false, nil
+		}
+	}
+
+	if p.MaxSteps > 0 {
+		if p.steps += e.steps; p.steps > p.MaxSteps {
+			return true, ErrBudgetExceeded
+		}
+	}
+	for _, key := range e.files {
+		p.files[key] = true
+	}
+	p.required = append(p.required, e.files...)
+	for _, m := range e.defs {
+		if err := p.define(m); err != nil {
+			return true, err
+		}
+	}
+	// The position of the file is that of the command that requires it,
+	// so the node itself is copied. Its children are shared.
+	fn := *e.node
+	fn.PosInfo = pi
+	fn.root = p.nod
+	p.nod.addNode(&fn)
+	p.outSize += fn.Len()
+	return true, nil
+}
+
+// shareState is the state of the parser before a file is parsed, from
+// which what parsing it did is determined.
+type shareState struct {
+	defs     map[string]Macro
+	required int
+	skipped  int
+	steps    int
+}
+
+func (p *Parser) shareState() shareState {
+	return shareState{p.Definitions(), len(p.required), p.skipped, p.steps}
+}
+
+// putRequired puts the tree fn, which was just parsed, into the
+// RequireCache, given the state of the parser before parsing it.
+func (p *Parser) putRequired(fn *FileNode, s shareState) {
+	if p.skipped != s.skipped {
+		// The tree lacks files that were already read, which another
+		// parser may not have read.
+		return
+	}
+	e := &requireEntry{
+		node:  fn,
+		depth: p.includeDepth,
+		files: append([]string(nil), p.required[s.required:]...),
+		steps: p.steps - s.steps,
+	}
+	for name, m := range p.defs {
+		if prev, ok := s.defs[name]; !ok || prev != m {
+			m.Prev = nil
+			e.defs = append(e.defs, m)
+		}
+	}
+	sort.Slice(e.defs, func(i, j int) bool { return e.defs[i].Name < e.defs[j].Name })
+	p.RequireCache.put(p.shareKey(fn.path), e)
+}
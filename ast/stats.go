@@ -0,0 +1,95 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ast
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Stats collect the wall-clock time that parsers spend on each file, so
+// that slow files, such as those on network file systems, can be found.
+// Stats may be used by several parsers at once.
+type Stats struct {
+	mu    sync.Mutex
+	files map[string]*FileStats
+}
+
+// FileStats are the times spent on a single file.
+type FileStats struct {
+	// Path is the resolved path of the file.
+	Path string
+
+	// Reads is the number of times the file was read.
+	Reads int
+
+	// Read is the time spent reading the file, and Parse the time spent
+	// lexing and parsing it, without the time spent on the files that it
+	// included.
+	Read  time.Duration
+	Parse time.Duration
+}
+
+// Total returns the time spent on the file.
+func (fs FileStats) Total() time.Duration { return fs.Read + fs.Parse }
+
+// NewStats returns new, empty Stats.
+func NewStats() *Stats {
+	return &Stats{files: make(map[string]*FileStats)}
+}
+
+// Files returns the stats of all files, the slowest first.
+func (s *Stats) Files() []FileStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fs := make([]FileStats, 0, len(s.files))
+	for _, f := range s.files {
+		fs = append(fs, *f)
+	}
+	sort.Slice(fs, func(i, j int) bool {
+		if ti, tj := fs[i].Total(), fs[j].Total(); ti != tj {
+			return ti > tj
+		}
+		return fs[i].Path < fs[j].Path
+	})
+	return fs
+}
+
+// Total returns the time spent on all files.
+func (s *Stats) Total() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var total time.Duration
+	for _, f := range s.files {
+		total += f.Total()
+	}
+	return total
+}
+
+func (s *Stats) add(path string, read, parse time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[path]
+	if !ok {
+		f = &FileStats{Path: path}
+		s.files[path] = f
+	}
+	f.Reads++
+	f.Read += read
+	f.Parse += parse
+}
+
+// timeFile adds the time since start to the Stats as spent on the file at
+// path, of which read was spent reading it, without the time spent on the
+// files it included. nested is the time spent on the files included by
+// the including file before it, to which the time is then added.
+func (p *Parser) timeFile(path string, start time.Time, read, nested time.Duration) {
+	total := time.Since(start)
+	if path != "" {
+		p.Stats.add(path, read, total-read-p.nested)
+	}
+	p.nested = nested + total
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package pre
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/goulash/pre/ast"
+)
+
+// DefaultBanner is a banner that can be used for Processor.Banner.
+const DefaultBanner = "generated by pre from {source} (sha256 {sha256}); do not edit"
+
+// writeBanner writes the Banner for the file at path to w, as a comment of
+// the first of the Commenters. Each line of the banner is a comment of its
+// own, and {source} and {sha256} are replaced by the name of the file in
+// positions and the hash of its content.
+func (p *Processor) writeBanner(w io.Writer, path string) error {
+	if len(p.Commenters) == 0 {
+		return errors.New("banner requires at least one commenter")
+	}
+	bs, err := p.readFile(path)
+	if err != nil {
+		return err
+	}
+	r := strings.NewReplacer(
+		"{source}", newParser(p).DisplayName(path),
+		"{sha256}", fmt.Sprintf("%x", sha256.Sum256(bs)),
+	)
+	var b strings.Builder
+	for _, line := range strings.Split(r.Replace(p.Banner), "\n") {
+		b.WriteString(commentLine(p.Commenters[0], line))
+	}
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// commentLine returns s as a line commented with c, such as "// s\n".
+func commentLine(c *ast.Commenter, s string) string {
+	if c.End == "" {
+		return c.Begin + " " + s + "\n"
+	}
+	return c.Begin + " " + s + " " + c.End + "\n"
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package pre
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/goulash/pre/ast"
+)
+
+// Bundle writes a zip archive to w that contains the file at path and all
+// the files it includes, directly or indirectly, so that it can be
+// processed without the original tree. The files keep their locations
+// relative to each other, and Bundle returns the name of the root file in
+// the archive. If the archive is written to bundle.zip, it can then be
+// processed with
+//
+//  p.Process(w, "bundle.zip!/"+name)
+//
+// The include commands in the files are not rewritten, so the files must
+// find each other by their relative paths alone. Bundle fails for files
+// that are found through IncludeMap, IncludePaths or absolute paths, and
+// for included directories, since these are not found in the archive.
+func (p *Processor) Bundle(w io.Writer, path string) (string, error) {
+	parser := newParser(p)
+	if err := parser.Parse(path); err != nil {
+		return "", err
+	}
+	root := parser.Root()
+
+	var files []string
+	seen := make(map[string]bool)
+	for _, f := range append([]string{root.Path()}, root.Dependencies()...) {
+		if !seen[f] {
+			seen[f] = true
+			files = append(files, f)
+		}
+	}
+
+	// All files are stored relative to the deepest directory containing them.
+	dir, err := commonDir(files)
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, len(files))
+	srcs := make([][]byte, len(files))
+	for i, f := range files {
+		if srcs[i], err = p.readFile(f); err != nil {
+			return "", err
+		}
+		name, err := filepath.Rel(dir, f)
+		if err != nil {
+			return "", err
+		}
+		names[i] = filepath.ToSlash(name)
+	}
+	if err := p.checkBundle(names, srcs); err != nil {
+		return "", err
+	}
+
+	zw := zip.NewWriter(w)
+	for i, name := range names {
+		fw, err := zw.Create(name)
+		if err != nil {
+			return "", err
+		}
+		if _, err := fw.Write(srcs[i]); err != nil {
+			return "", err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return names[0], nil
+}
+
+// checkBundle parses the first of the files names with the contents srcs
+// as they would be found in the archive, and returns an error unless it
+// includes the same files as the original tree.
+func (p *Processor) checkBundle(names []string, srcs [][]byte) error {
+	fs := make(ast.MapFS, len(names))
+	abs := func(name string) string {
+		path, _ := fs.Abs(filepath.Join("bundle", filepath.FromSlash(name)))
+		return path
+	}
+	for i, name := range names {
+		fs[abs(name)] = string(srcs[i])
+	}
+
+	// Only the settings that decide which files are found are changed,
+	// and nothing is reported twice. Errors name the files in the archive.
+	q := *p
+	q.FS = fs
+	q.NameBase = abs("")
+	q.SlashNames = true
+	q.IncludeMap = nil
+	q.IncludePaths = nil
+	q.RequireCache = nil
+	q.ResourceCache = nil
+	q.Stats = nil
+	q.Metrics = nil
+	q.Diagnostics = nil
+	q.Messages = nil
+	q.Commands = nil
+	parser := newParser(&q)
+	if err := parser.Parse(abs(names[0])); err != nil {
+		return fmt.Errorf("cannot bundle %s without IncludeMap, IncludePaths and absolute paths: %w", names[0], err)
+	}
+	found := make(map[string]bool)
+	for _, dep := range parser.Root().Dependencies() {
+		found[dep] = true
+	}
+	for _, name := range names[1:] {
+		if !found[abs(name)] {
+			return fmt.Errorf("cannot bundle %s: %s is not included by a relative path", names[0], name)
+		}
+	}
+	return nil
+}
+
+// commonDir returns the deepest directory that contains all files, which
+// fails if there is none, such as for files on different volumes.
+func commonDir(files []string) (string, error) {
+	dir := filepath.Dir(files[0])
+	for _, f := range files {
+		for !within(dir, f) {
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				return "", fmt.Errorf("%s and %s are not in a common directory", files[0], f)
+			}
+			dir = parent
+		}
+	}
+	return dir, nil
+}
+
+// within returns true if path is inside of the directory dir.
+func within(dir, path string) bool {
+	if !strings.HasSuffix(dir, string(filepath.Separator)) {
+		dir += string(filepath.Separator)
+	}
+	return strings.HasPrefix(path, dir)
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package pre
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// A cacheEntry records the files that a cached output was rendered from,
+// together with the hashes of their contents at that time, the files that
+// were looked for but did not exist, and the hashes of the listings of the
+// directories that were included.
+type cacheEntry struct {
+	Deps    map[string]string `json:"deps"`
+	Missing []string          `json:"missing,omitempty"`
+	Dirs    map[string]string `json:"dirs,omitempty"`
+}
+
+// processCached is like render, except that the output is taken from
+// CacheDir if none of the files it depends on have changed since it was
+// stored there. Otherwise the file is processed and the output is stored.
+func (p *Processor) processCached(w io.Writer, path string) error {
+	key, err := p.cacheKey(path)
+	if err != nil {
+		return err
+	}
+	base := filepath.Join(p.CacheDir, key)
+	if out, ok := readCache(base); ok {
+		_, err := w.Write(out)
+		return err
+	}
+
+	parser := newParser(p)
+	parser.Mmap = p.Mmap
+	defer parser.Close()
+	if err := parser.Parse(path); err != nil {
+		return err
+	}
+	root := parser.Root()
+	var buf bytes.Buffer
+	if _, err := root.WriteTo(&buf); err != nil {
+		return err
+	}
+
+	entry := cacheEntry{Deps: make(map[string]string), Missing: parser.Missing()}
+	for _, dep := range root.Dependencies() {
+		sum, err := sumFile(dep)
+		if err != nil {
+			return err
+		}
+		entry.Deps[dep] = sum
+	}
+	for _, dir := range parser.Dirs() {
+		sum, err := sumDir(dir)
+		if err != nil {
+			return err
+		}
+		if entry.Dirs == nil {
+			entry.Dirs = make(map[string]string)
+		}
+		entry.Dirs[dir] = sum
+	}
+	if err := writeCache(base, &entry, buf.Bytes()); err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// cacheKey returns the key under which the output of the file at path is
+// cached. It covers the path, the content of the file, and the settings of
+// the processor, since any of these can change the output.
+func (p *Processor) cacheKey(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	// Filters are applied after the output is taken from the cache,
+	// and Diagnostics does not affect the output.
+	q := *p
+	q.Filters = nil
+	q.Diagnostics = nil
+	settings, err := json.Marshal(&q)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", settings, abs)
+	if err := hashFile(h, path); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// readCache returns the output cached under base, if it exists and all the
+// files it was rendered from are unchanged, none of the files that were
+// missing exist now, and no files were added to or removed from the
+// directories that were included.
+func readCache(base string) ([]byte, bool) {
+	bs, err := ioutil.ReadFile(base + ".json")
+	if err != nil {
+		return nil, false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(bs, &entry); err != nil {
+		return nil, false
+	}
+	for dep, want := range entry.Deps {
+		if sum, err := sumFile(dep); err != nil || sum != want {
+			return nil, false
+		}
+	}
+	for _, path := range entry.Missing {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			return nil, false
+		}
+	}
+	for dir, want := range entry.Dirs {
+		if sum, err := sumDir(dir); err != nil || sum != want {
+			return nil, false
+		}
+	}
+	out, err := ioutil.ReadFile(base + ".out")
+	if err != nil {
+		return nil, false
+	}
+	return out, true
+}
+
+// writeCache stores out and its entry under base. The output is written
+// first, so that an entry is never read without its output.
+func writeCache(base string, entry *cacheEntry, out []byte) error {
+	bs, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(base), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(base+".out", out, 0644); err != nil {
+		return err
+	}
+	return writeFileAtomic(base+".json", bs, 0644)
+}
+
+// sumFile returns the hex-encoded SHA-256 digest of the file at path.
+func sumFile(path string) (string, error) {
+	h := sha256.New()
+	if err := hashFile(h, path); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// sumDir returns the hex-encoded SHA-256 digest of the names of the files
+// in the directory dir, which changes when files are added or removed.
+func sumDir(dir string) (string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			fmt.Fprintf(h, "%s\x00", fi.Name())
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
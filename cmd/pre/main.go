@@ -0,0 +1,16 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+// Command pre processes a file, for use with go generate:
+//
+//  //go:generate pre -o config.gen.go config.go.pre
+//
+// See package github.com/goulash/pre/generate for details.
+package main
+
+import "github.com/goulash/pre/generate"
+
+func main() {
+	generate.Main()
+}
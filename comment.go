@@ -9,7 +9,7 @@ import "github.com/goulash/pre/ast"
 var (
 	LispComment = PrefixCommenter(";")
 	CppComment  = PrefixCommenter("//")
-	CComment    = &ast.Commenter{"/*", "*/", false}
+	CComment    = &ast.Commenter{Begin: "/*", End: "*/"}
 )
 
 func PrefixCommenter(prefix string) *ast.Commenter {
@@ -0,0 +1,119 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package pre
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/goulash/pre/ast"
+)
+
+// ConfigName is the name of the file that holds the configuration of
+// a project, see LoadConfig.
+const ConfigName = ".prerc"
+
+// ErrTOMLConfig is returned by LoadConfig if the configuration of a project
+// is in a file named pre.toml, which is not supported. Use ConfigName with
+// the same settings in JSON instead.
+var ErrTOMLConfig = errors.New("pre.toml is not supported, use " + ConfigName)
+
+// A Config holds the settings of a project, so that they do not have to be
+// repeated on every invocation. It is stored as JSON in a file named
+// ConfigName, such as:
+//
+//  {
+//  	"trigger": "#",
+//  	"commenters": [{"begin": "//", "strip": true}],
+//  	"include_paths": ["include"],
+//  	"defines": {"VERSION": "1.2"},
+//  	"patterns": ["*.pre"]
+//  }
+//
+// All settings are optional. Include paths are searched for files included
+// as #include <file>.
+type Config struct {
+	Trigger      string            `json:"trigger"`
+	Commenters   []*ast.Commenter  `json:"commenters"`
+	IncludePaths []string          `json:"include_paths"`
+	Defines      map[string]string `json:"defines"`
+	Patterns     []string          `json:"patterns"`
+
+	// Path is the path of the file that the configuration was loaded from.
+	Path string `json:"-"`
+}
+
+// LoadConfig finds the configuration for the file at path, which is in the
+// nearest file named ConfigName in the directory of path or one of its
+// parents, and loads it. If there is none, LoadConfig returns nil and no
+// error. Relative include paths are made relative to the directory of the
+// configuration. If the nearest configuration is a pre.toml, LoadConfig
+// returns ErrTOMLConfig instead of ignoring it.
+func LoadConfig(path string) (*Config, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	for dir := filepath.Dir(abs); ; dir = filepath.Dir(dir) {
+		name := filepath.Join(dir, ConfigName)
+		bs, err := ioutil.ReadFile(name)
+		if err == nil {
+			return parseConfig(name, bs)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if _, err := os.Stat(filepath.Join(dir, "pre.toml")); err == nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Join(dir, "pre.toml"), ErrTOMLConfig)
+		}
+		if filepath.Dir(dir) == dir {
+			return nil, nil
+		}
+	}
+}
+
+func parseConfig(name string, bs []byte) (*Config, error) {
+	var c Config
+	if err := json.Unmarshal(bs, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	c.Path = name
+	for i, dir := range c.IncludePaths {
+		dir = filepath.FromSlash(dir)
+		if !filepath.IsAbs(dir) {
+			c.IncludePaths[i] = filepath.Join(filepath.Dir(name), dir)
+		}
+	}
+	return &c, nil
+}
+
+// Apply applies the settings of c to p. Settings that c does not have
+// are left as they are, while defines are added to those of p.
+func (c *Config) Apply(p *Processor) {
+	if c.Trigger != "" {
+		p.Trigger = c.Trigger
+	}
+	if len(c.Commenters) > 0 {
+		p.Commenters = c.Commenters
+	}
+	if len(c.IncludePaths) > 0 {
+		p.IncludePaths = c.IncludePaths
+	}
+	if len(c.Patterns) > 0 {
+		p.Patterns = c.Patterns
+	}
+	names := make([]string, 0, len(c.Defines))
+	for name := range c.Defines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p.Defines = append(p.Defines, ast.Macro{Name: name, Value: c.Defines[name], Source: ast.SourceConfig})
+	}
+}
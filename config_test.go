@@ -0,0 +1,78 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package pre
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sub := filepath.Join(dir, "src", "deep")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		z.Fatal(err)
+	}
+	rc := `{"trigger": "@", "commenters": [{"begin": "//", "strip": true}], "include_paths": ["inc"], "defines": {"A": "1"}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, ConfigName), []byte(rc), 0644); err != nil {
+		z.Fatal(err)
+	}
+	path := filepath.Join(sub, "a.txt")
+	if err := ioutil.WriteFile(path, []byte("// gone\n@define B 2\n@include <b.txt>\ntext\n"), 0644); err != nil {
+		z.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "inc"), 0755); err != nil {
+		z.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "inc", "b.txt"), []byte("B\n"), 0644); err != nil {
+		z.Fatal(err)
+	}
+
+	c, err := LoadConfig(path)
+	if err != nil {
+		z.Fatal(err)
+	}
+	if c == nil || c.Path != filepath.Join(dir, ConfigName) {
+		z.Fatalf("LoadConfig() = %v, want the config in %s", c, dir)
+	}
+	if exp := filepath.Join(dir, "inc"); len(c.IncludePaths) != 1 || c.IncludePaths[0] != exp {
+		z.Errorf("IncludePaths = %q, want %q", c.IncludePaths, exp)
+	}
+	p := New()
+	c.Apply(p)
+	var buf bytes.Buffer
+	if err := p.Process(&buf, path); err != nil {
+		z.Fatal(err)
+	}
+	if s := buf.String(); s != "\nB\ntext\n" {
+		z.Errorf("Process() = %q, want %q", s, "\nB\ntext\n")
+	}
+	if len(p.Defines) != 1 || p.Defines[0].Name != "A" {
+		z.Errorf("Defines = %v, want A", p.Defines)
+	}
+
+	if c, err := LoadConfig(filepath.Join(os.TempDir(), "no-such-dir", "a.txt")); err != nil || c != nil {
+		z.Errorf("LoadConfig() without config = %v, %v, want nil", c, err)
+	}
+
+	toml := filepath.Join(dir, "toml")
+	if err := os.Mkdir(toml, 0755); err != nil {
+		z.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(toml, "pre.toml"), []byte("trigger = \"@\"\n"), 0644); err != nil {
+		z.Fatal(err)
+	}
+	if _, err := LoadConfig(filepath.Join(toml, "a.txt")); !errors.Is(err, ErrTOMLConfig) {
+		z.Errorf("LoadConfig() with pre.toml error = %v, want %v", err, ErrTOMLConfig)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package pre
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ProcessDir walks the directory tree src and recreates it in dst.
+// Files whose name matches one of the Patterns are processed and renamed
+// according to Rename, all other regular files are copied verbatim.
+// Permissions are preserved, but anything that is not a regular file or
+// directory is skipped.
+func (p *Processor) ProcessDir(src, dst string) error {
+	return p.walkDir(src, dst, func(path, target string, fi os.FileInfo, q *Processor) error {
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, fi.Mode().Perm())
+		case q != nil:
+			return q.processFile(path, target, fi.Mode().Perm())
+		default:
+			return copyFile(path, target, fi.Mode().Perm())
+		}
+	})
+}
+
+// CheckDir is like ProcessDir, except that nothing is written. Instead, the
+// paths of all files in dst that are missing or differ from what ProcessDir
+// would write are returned. This is useful to check that generated files
+// are up-to-date.
+func (p *Processor) CheckDir(src, dst string) ([]string, error) {
+	var stale []string
+	err := p.walkDir(src, dst, func(path, target string, fi os.FileInfo, q *Processor) error {
+		if fi.IsDir() {
+			return nil
+		}
+
+		var exp []byte
+		if q != nil {
+			var buf bytes.Buffer
+			if err := q.Process(&buf, path); err != nil {
+				return err
+			}
+			exp = buf.Bytes()
+		} else {
+			bs, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			exp = bs
+		}
+
+		got, err := ioutil.ReadFile(target)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err != nil || !bytes.Equal(got, exp) {
+			stale = append(stale, target)
+		}
+		return nil
+	})
+	return stale, err
+}
+
+// walkDir calls fn for every directory and regular file in the tree src,
+// with target set to the corresponding path in dst. If q is not nil, the
+// file is to be processed by q, and target has already been renamed.
+func (p *Processor) walkDir(src, dst string, fn func(path, target string, fi os.FileInfo, q *Processor) error) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case fi.IsDir():
+			return fn(path, target, fi, nil)
+		case !fi.Mode().IsRegular():
+			return nil
+		}
+
+		q, err := p.route(fi.Name())
+		if err != nil {
+			return err
+		}
+		if q != nil {
+			target = p.rename(target)
+		}
+		return fn(path, target, fi, q)
+	})
+}
+
+// route returns the Processor of the first route whose pattern matches
+// name, or p if name matches one of the Patterns, or nil otherwise.
+func (p *Processor) route(name string) (*Processor, error) {
+	for _, r := range p.Routes {
+		ok, err := filepath.Match(r.Pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return r.Processor, nil
+		}
+	}
+	ok, err := p.matches(name)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return p, nil
+}
+
+// matches returns true if name matches one of the Patterns.
+func (p *Processor) matches(name string) (bool, error) {
+	for _, pat := range p.Patterns {
+		ok, err := filepath.Match(pat, name)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// rename applies the first matching Rename rule to the file name of path.
+func (p *Processor) rename(path string) string {
+	dir, name := filepath.Split(path)
+	for _, r := range p.Rename {
+		if strings.HasSuffix(name, r.From) && len(name) > len(r.From) {
+			return filepath.Join(dir, strings.TrimSuffix(name, r.From)+r.To)
+		}
+	}
+	return path
+}
+
+// processFile processes src and writes the result to dst with permissions
+// perm. The output is only written once processing succeeds, so that a
+// failed run leaves dst as it was.
+func (p *Processor) processFile(src, dst string, perm os.FileMode) error {
+	var buf bytes.Buffer
+	if err := p.Process(&buf, src); err != nil {
+		return err
+	}
+	return writeFileAtomic(dst, buf.Bytes(), perm)
+}
+
+// copyFile copies src to dst verbatim with permissions perm.
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := createFile(dst, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// createFile creates or truncates the file at path and makes sure it has
+// the permissions perm, even if it already existed.
+func createFile(path string, perm os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
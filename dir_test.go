@@ -0,0 +1,154 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package pre
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProcessDir(z *testing.T) {
+	dst, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	p := New()
+	p.Patterns = []string{"*.pre"}
+	p.Rename = []Rename{{".txt.pre", ".txt"}, {".pre", ""}}
+	if err := p.ProcessDir("testdata/tree", dst); err != nil {
+		z.Fatal(err)
+	}
+
+	var files = []struct {
+		Path string
+		Exp  string
+	}{
+		{"index", "This file is processed:\nThis part is included.\n"},
+		{"sub/notes.txt", "Rendered: #not a directive, since it is not at the start of a line\n"},
+		{"sub/part.txt", "This part is included.\n"},
+		{"sub/verbatim.txt", "#include \"this is copied verbatim\"\n"},
+	}
+	for _, f := range files {
+		bs, err := ioutil.ReadFile(filepath.Join(dst, f.Path))
+		if err != nil {
+			z.Error(err)
+			continue
+		}
+		if string(bs) != f.Exp {
+			z.Errorf("ProcessDir output %s = %q, want %q", f.Path, bs, f.Exp)
+		}
+	}
+}
+
+func TestCheckDir(z *testing.T) {
+	dst, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	p := New()
+	p.Patterns = []string{"*.pre"}
+	stale, err := p.CheckDir("testdata/tree", dst)
+	if err != nil {
+		z.Fatal(err)
+	}
+	if len(stale) != 4 {
+		z.Errorf("CheckDir on empty dst = %v, want all 4 files", stale)
+	}
+
+	if err := p.ProcessDir("testdata/tree", dst); err != nil {
+		z.Fatal(err)
+	}
+	stale, err = p.CheckDir("testdata/tree", dst)
+	if err != nil {
+		z.Fatal(err)
+	}
+	if len(stale) != 0 {
+		z.Errorf("CheckDir after ProcessDir = %v, want none", stale)
+	}
+}
+
+func TestProcessDirRoutes(z *testing.T) {
+	dst, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	at := New()
+	at.Trigger = "@"
+	p := New()
+	p.Patterns = []string{"*.pre"}
+	p.Rename = []Rename{{".txt.pre", ".txt"}, {".pre", ""}}
+	p.Routes = []Route{{"index.pre", at}, {"verbatim.txt", at}}
+	if err := p.ProcessDir("testdata/tree", dst); err != nil {
+		z.Fatal(err)
+	}
+
+	var files = []struct {
+		Path string
+		Exp  string
+	}{
+		{"index", "This file is processed:\n#include \"sub/part.txt\"\n"},
+		{"sub/notes.txt", "Rendered: #not a directive, since it is not at the start of a line\n"},
+		{"sub/verbatim.txt", "#include \"this is copied verbatim\"\n"},
+	}
+	for _, f := range files {
+		bs, err := ioutil.ReadFile(filepath.Join(dst, f.Path))
+		if err != nil {
+			z.Error(err)
+			continue
+		}
+		if string(bs) != f.Exp {
+			z.Errorf("ProcessDir output %s = %q, want %q", f.Path, bs, f.Exp)
+		}
+	}
+
+	stale, err := p.CheckDir("testdata/tree", dst)
+	if err != nil {
+		z.Fatal(err)
+	}
+	if len(stale) != 0 {
+		z.Errorf("CheckDir after ProcessDir = %v, want none", stale)
+	}
+}
+
+func TestProcessDirError(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	for _, d := range []string{src, dst} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			z.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "a.pre"), []byte("A\n#error \"failed\"\n"), 0644); err != nil {
+		z.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dst, "a"), []byte("old\n"), 0644); err != nil {
+		z.Fatal(err)
+	}
+
+	p := New()
+	p.Patterns = []string{"*.pre"}
+	p.Rename = []Rename{{".pre", ""}}
+	if err := p.ProcessDir(src, dst); err == nil {
+		z.Fatal("ProcessDir() did not fail")
+	}
+	if bs, err := ioutil.ReadFile(filepath.Join(dst, "a")); err != nil || string(bs) != "old\n" {
+		z.Errorf("ProcessDir() left %q, %v, want the old output", bs, err)
+	}
+	if fis, err := ioutil.ReadDir(dst); err != nil || len(fis) != 1 {
+		z.Errorf("ProcessDir() left %d files, %v, want 1", len(fis), err)
+	}
+}
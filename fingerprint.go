@@ -0,0 +1,57 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package pre
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/goulash/pre/ast"
+)
+
+// Fingerprint returns the hex-encoded SHA-256 digest of the output of
+// Process for the file at path. Unless Filters are set or the output is
+// taken from CacheDir, the output is hashed as it is rendered, so it is
+// never held in memory in its entirety.
+func (p *Processor) Fingerprint(path string) (string, error) {
+	h := sha256.New()
+	if err := p.Process(h, path); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// ClosureFingerprint returns the hex-encoded SHA-256 digest of the file at
+// path and of all the files it includes, directly or indirectly. Unlike
+// Fingerprint, it changes whenever any of these files change, even if the
+// change does not affect the output, such as in a stripped comment.
+func (p *Processor) ClosureFingerprint(path string) (string, error) {
+	parser := newParser(p)
+	if err := parser.Parse(path); err != nil {
+		return "", err
+	}
+	root := parser.Root()
+
+	h := sha256.New()
+	for _, dep := range append([]string{root.Path()}, root.Dependencies()...) {
+		fmt.Fprintf(h, "%s\x00", dep)
+		if err := hashFile(h, dep); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// hashFile writes the content of the file at path to w. The file may be
+// in an archive, as understood by ast.ReadFile.
+func hashFile(w io.Writer, path string) error {
+	bs, err := ast.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(bs)
+	return err
+}
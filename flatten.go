@@ -0,0 +1,85 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package pre
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+
+	"github.com/goulash/pre/ast"
+)
+
+// Flatten writes the file at path to w with all include and require
+// commands replaced by the files they refer to, but without any other
+// transformation: comments are kept, headers are not replaced, neither
+// symbols nor builtins are replaced, no final newline is added, and the
+// Filters are not applied. Directives that pre does not resolve are kept
+// verbatim, as with KeepDirectives, and so are pragmas, which then apply
+// when the output is processed. An error command still fails, as do
+// includes with via, since their content cannot be included untransformed.
+//
+// If markers is true, each included file is enclosed in comments of the
+// first of the Commenters, such as
+//
+//  // begin include partials/head.html
+//  ...
+//  // end include partials/head.html
+//
+// where the path is relative to the directory of the file at path.
+func (p *Processor) Flatten(w io.Writer, path string, markers bool) error {
+	q := *p
+	q.Dialect = DialectPre
+	q.KeepDirectives = true
+	q.keepPragmas = true
+	q.HeaderLines = 0
+	q.Symbols = nil
+	q.Builtins = false
+	q.PlatformBuiltins = false
+	q.Transformers = nil
+	q.FinalNewline = false
+	q.Filters = nil
+	q.Hooks = nil
+	q.Banner = ""
+	q.CacheDir = ""
+	q.Commenters = make(ast.Commenters, len(p.Commenters))
+	for i, c := range p.Commenters {
+		c := *c
+		c.Strip = false
+		q.Commenters[i] = &c
+	}
+
+	if markers {
+		if len(p.Commenters) == 0 {
+			return errors.New("markers require at least one commenter")
+		}
+		c := p.Commenters[0]
+
+		var dir string
+		var depth int
+		name := func(fn *ast.FileNode) string {
+			if rel, err := filepath.Rel(dir, fn.Path()); err == nil {
+				return filepath.ToSlash(rel)
+			}
+			return fn.Path()
+		}
+		q.Hooks = &ast.Hooks{
+			OnFileEnter: func(fn *ast.FileNode) string {
+				if depth++; depth == 1 {
+					dir = filepath.Dir(fn.Path())
+					return ""
+				}
+				return commentLine(c, "begin include "+name(fn))
+			},
+			OnFileExit: func(fn *ast.FileNode) string {
+				if depth--; depth == 0 {
+					return ""
+				}
+				return commentLine(c, "end include "+name(fn))
+			},
+		}
+	}
+	return q.Process(w, path)
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+// Package generate runs pre from go generate. With the pre command
+// installed, a Go file can contain the line
+//
+//  //go:generate pre -o config.gen.go config.go.pre
+//
+// to create config.gen.go from config.go.pre. The variables that go generate
+// sets in the environment are available in the processed file as symbols:
+// GOFILE as __GOFILE__, GOPACKAGE as __GOPACKAGE__, and so on. A template
+// can therefore begin with
+//
+//  package __GOPACKAGE__
+//
+// and be used in any package. The variables are also defined as macros of
+// the same name, and further macros can be defined with -D name=value.
+package generate
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/goulash/pre"
+	"github.com/goulash/pre/ast"
+)
+
+// Variables are the environment variables set by go generate that are
+// made available as symbols.
+var Variables = []string{"GOARCH", "GOOS", "GOFILE", "GOLINE", "GOPACKAGE", "GOROOT"}
+
+// Symbols returns the symbols for the Variables that are set in the
+// environment. The symbol of the variable GOFILE is __GOFILE__.
+func Symbols() map[string]string {
+	m := make(map[string]string)
+	for _, v := range Variables {
+		if s, ok := os.LookupEnv(v); ok {
+			m["__"+v+"__"] = s
+		}
+	}
+	return m
+}
+
+// Defines returns the macros for the Variables that are set in the
+// environment.
+func Defines() []ast.Macro {
+	var ms []ast.Macro
+	for _, v := range Variables {
+		if s, ok := os.LookupEnv(v); ok {
+			ms = append(ms, ast.Macro{Name: v, Value: s, Source: ast.SourceEnvironment})
+		}
+	}
+	return ms
+}
+
+// defineFlag collects the macros given with -D on the command line.
+type defineFlag []ast.Macro
+
+func (d *defineFlag) String() string { return "" }
+
+func (d *defineFlag) Set(s string) error {
+	m := ast.Macro{Name: s, Source: ast.SourceCommandLine}
+	if i := strings.IndexByte(s, '='); i >= 0 {
+		m.Name, m.Value = s[:i], s[i+1:]
+	}
+	if m.Name == "" {
+		return errors.New("macro name is empty")
+	}
+	*d = append(*d, m)
+	return nil
+}
+
+// Exit statuses of Main, as returned by ExitCode.
+const (
+	ExitOK        = 0 // all files were processed
+	ExitUsage     = 1 // the command line is invalid
+	ExitParse     = 2 // a file could not be processed
+	ExitUserError = 3 // a file failed with the error command
+	ExitCheck     = 4 // an output is out of date, with -check
+)
+
+// usageError is an error in the command line.
+type usageError struct{ error }
+
+// ErrOutOfDate is returned with -check if the output file differs from
+// what would be written.
+var ErrOutOfDate = errors.New("output is out of date")
+
+// Errors are the errors of several files, in order.
+type Errors []error
+
+func (es Errors) Error() string {
+	ss := make([]string, len(es))
+	for i, err := range es {
+		ss[i] = err.Error()
+	}
+	return strings.Join(ss, "\n")
+}
+
+// ExitCode returns the exit status for an error returned by Run. For
+// Errors, it is the status of the first error.
+func ExitCode(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return ExitOK
+	case usageError:
+		return ExitUsage
+	case Errors:
+		return ExitCode(e[0])
+	case *ast.Error:
+		if _, ok := e.Err.(*ast.UserError); ok {
+			return ExitUserError
+		}
+	}
+	switch {
+	case err == flag.ErrHelp:
+		return ExitOK
+	case errors.Is(err, ErrOutOfDate):
+		return ExitCheck
+	default:
+		return ExitParse
+	}
+}
+
+// Run processes the files given in args, which are the command line
+// arguments without the program name. The output is written to the file
+// given with -o, unless it is unchanged, or to standard output. Each
+// processor is configured for the language of the file, as by pre.ForFile,
+// and then by the nearest project configuration, as by pre.LoadConfig.
+//
+// With -check, the output is compared to the file given with -o instead of
+// being written, and ErrOutOfDate is returned if they differ. Processing
+// stops once -max-errors files have failed, unless it is zero.
+func Run(args []string) error {
+	fs := flag.NewFlagSet("pre", flag.ContinueOnError)
+	out := fs.String("o", "", "write output to `file` instead of standard output")
+	check := fs.Bool("check", false, "check that the file given with -o is up to date")
+	maxErrors := fs.Int("max-errors", 0, "stop after `n` files have failed, or never if 0")
+	var defs defineFlag
+	fs.Var(&defs, "D", "define the macro `name[=value]`")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return usageError{err}
+	}
+	switch {
+	case fs.NArg() == 0:
+		return usageError{errors.New("expecting at least one file to process")}
+	case *out != "" && fs.NArg() > 1:
+		return usageError{errors.New("only one file can be processed with -o")}
+	case *check && *out == "":
+		return usageError{errors.New("-check requires -o")}
+	}
+
+	var errs Errors
+	for _, src := range fs.Args() {
+		if err := run(src, *out, *check, defs); err != nil {
+			errs = append(errs, err)
+			if len(errs) == *maxErrors {
+				break
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// run processes the file src as described by Run.
+func run(src, out string, check bool, defs []ast.Macro) error {
+	p, err := pre.ForFile(src)
+	if err != nil {
+		p = pre.New()
+	}
+	p.Symbols = Symbols()
+	p.Diagnostics = ast.WriterSink(os.Stderr)
+	p.Defines = Defines()
+	c, err := pre.LoadConfig(src)
+	if err != nil {
+		return err
+	}
+	if c != nil {
+		c.Apply(p)
+	}
+	p.Defines = append(p.Defines, defs...)
+
+	// The output is only written once processing succeeds, so that a
+	// failed run does not leave a truncated file behind.
+	var buf bytes.Buffer
+	if err := p.Process(&buf, src); err != nil {
+		return err
+	}
+	switch {
+	case out == "":
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	case check:
+		bs, err := ioutil.ReadFile(out)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err != nil || !bytes.Equal(bs, buf.Bytes()) {
+			return fmt.Errorf("%s: %w", out, ErrOutOfDate)
+		}
+		return nil
+	default:
+		_, err = pre.WriteFileIfChanged(out, buf.Bytes(), 0644)
+		return err
+	}
+}
+
+// Main calls Run with the command line arguments, prints the errors if it
+// fails, and exits with the status given by ExitCode.
+func Main() {
+	err := Run(os.Args[1:])
+	if err != nil && err != flag.ErrHelp {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintf(os.Stderr, "pre: %s\n", line)
+		}
+	}
+	os.Exit(ExitCode(err))
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package generate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExitCode(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"ok.txt":        "A\n",
+		"parse.txt":     "#foo\n",
+		"user.txt":      "#error \"unsupported\"\n",
+		"ok.txt.out":    "A\n",
+		"stale.txt.out": "B\n",
+	}
+	for name, s := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(s), 0644); err != nil {
+			z.Fatal(err)
+		}
+	}
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	var tests = []struct {
+		Args []string
+		Code int
+	}{
+		{[]string{"-check", "-o", path("ok.txt.out"), path("ok.txt")}, ExitOK},
+		{[]string{}, ExitUsage},
+		{[]string{"-bogus", path("ok.txt")}, ExitUsage},
+		{[]string{"-o", path("x"), path("ok.txt"), path("ok.txt")}, ExitUsage},
+		{[]string{"-o", path("x"), path("parse.txt")}, ExitParse},
+		{[]string{"-o", path("x"), path("user.txt")}, ExitUserError},
+		{[]string{"-check", "-o", path("stale.txt.out"), path("ok.txt")}, ExitCheck},
+	}
+	for _, t := range tests {
+		if code := ExitCode(Run(t.Args)); code != t.Code {
+			z.Errorf("Run(%q) exit code = %d, want %d", t.Args, code, t.Code)
+		}
+	}
+
+	err = Run([]string{"-max-errors", "1", path("parse.txt"), path("user.txt")})
+	if es, ok := err.(Errors); !ok || len(es) != 1 {
+		z.Errorf("Run() with -max-errors 1 = %v, want one error", err)
+	}
+}
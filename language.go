@@ -0,0 +1,141 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package pre
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/goulash/pre/ast"
+)
+
+// language describes how pre should be configured for a language.
+type language struct {
+	trigger    string
+	commenters []ast.Commenter
+	quotes     string
+}
+
+var (
+	cLike = language{
+		trigger:    "#",
+		commenters: []ast.Commenter{{Begin: "//"}, {Begin: "/*", End: "*/"}},
+		quotes:     `"'`,
+	}
+	hashLike = language{
+		// The default trigger would turn every comment into a command.
+		trigger:    "#:",
+		commenters: []ast.Commenter{{Begin: "#"}},
+		quotes:     `"'`,
+	}
+	markupLike = language{
+		trigger:    "#",
+		commenters: []ast.Commenter{{Begin: "<!--", End: "-->"}},
+	}
+)
+
+var languages = map[string]language{
+	"c":          cLike,
+	"cpp":        cLike,
+	"go":         {"#", cLike.commenters, "\"'`"},
+	"java":       cLike,
+	"javascript": {"#", cLike.commenters, "\"'`"},
+	"rust":       {"#", cLike.commenters, `"`},
+	"css":        {"#", []ast.Commenter{{Begin: "/*", End: "*/"}}, `"'`},
+	"python":     hashLike,
+	"shell":      hashLike,
+	"yaml":       hashLike,
+	"make":       {"#:", hashLike.commenters, ""},
+	"html":       markupLike,
+	"xml":        markupLike,
+	"sql":        {"#", []ast.Commenter{{Begin: "--"}, {Begin: "/*", End: "*/"}}, `'`},
+	"lisp":       {"#", []ast.Commenter{{Begin: ";"}}, `"`},
+}
+
+var extensions = map[string]string{
+	".c":    "c",
+	".h":    "c",
+	".cc":   "cpp",
+	".cpp":  "cpp",
+	".cxx":  "cpp",
+	".hh":   "cpp",
+	".hpp":  "cpp",
+	".go":   "go",
+	".java": "java",
+	".js":   "javascript",
+	".rs":   "rust",
+	".css":  "css",
+	".py":   "python",
+	".sh":   "shell",
+	".bash": "shell",
+	".yml":  "yaml",
+	".yaml": "yaml",
+	".mk":   "make",
+	".html": "html",
+	".htm":  "html",
+	".xml":  "xml",
+	".svg":  "xml",
+	".sql":  "sql",
+	".lisp": "lisp",
+	".el":   "lisp",
+	".scm":  "lisp",
+}
+
+// ForLanguage returns a new Processor that is configured for the language
+// lang, such as "c", "go", "python", or "html". The comments of the language
+// are recognized, but not stripped. Use Languages for a list of all
+// supported languages.
+func ForLanguage(lang string) (*Processor, error) {
+	l, ok := languages[lang]
+	if !ok {
+		return nil, fmt.Errorf("unknown language %q", lang)
+	}
+
+	p := New()
+	p.Trigger = l.trigger
+	p.Quotes = l.quotes
+	for _, c := range l.commenters {
+		c := c
+		p.AddCommenter(&c, false)
+	}
+	return p, nil
+}
+
+// ForFile returns a new Processor that is configured for the language of
+// the file at path, as determined by LanguageOf.
+func ForFile(path string) (*Processor, error) {
+	lang := LanguageOf(path)
+	if lang == "" {
+		return nil, fmt.Errorf("unknown language of file %s", path)
+	}
+	return ForLanguage(lang)
+}
+
+// LanguageOf returns the language of the file at path according to its
+// extension, or the empty string if it is unknown. If the last extension
+// is unknown, the one before it is tried, so that main.c.in is C.
+func LanguageOf(path string) string {
+	name := strings.ToLower(filepath.Base(path))
+	for i := 0; i < 2; i++ {
+		ext := filepath.Ext(name)
+		if lang, ok := extensions[ext]; ok {
+			return lang
+		}
+		name = strings.TrimSuffix(name, ext)
+	}
+	return ""
+}
+
+// Languages returns the names of all languages known to ForLanguage.
+func Languages() []string {
+	langs := make([]string, 0, len(languages))
+	for lang := range languages {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
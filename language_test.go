@@ -0,0 +1,47 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package pre
+
+import "testing"
+
+func TestLanguageOf(z *testing.T) {
+	var tests = []struct {
+		Path string
+		Lang string
+	}{
+		{"main.c", "c"},
+		{"src/main.c.in", "c"},
+		{"Config.YAML", "yaml"},
+		{"index.html.pre", "html"},
+		{"README", ""},
+	}
+	for _, t := range tests {
+		if lang := LanguageOf(t.Path); lang != t.Lang {
+			z.Errorf("LanguageOf(%q) = %q, want %q", t.Path, lang, t.Lang)
+		}
+	}
+}
+
+func TestForLanguage(z *testing.T) {
+	for _, lang := range Languages() {
+		if _, err := ForLanguage(lang); err != nil {
+			z.Error(err)
+		}
+	}
+
+	p, err := ForLanguage("python")
+	if err != nil {
+		z.Fatal(err)
+	}
+	const test = "# A comment, not a command.\n#:include \"child.test\"\nurl = \"http://x#y\"\n"
+	n, err := p.ParseString("testdata/internal", test)
+	if err != nil {
+		z.Fatal(err)
+	}
+	const exp = "# A comment, not a command.\nThis is the child text, included by the parent file.\nEOF\nurl = \"http://x#y\"\n"
+	if n.String() != exp {
+		z.Errorf("ParseString(%q) = %q, want %q", test, n.String(), exp)
+	}
+}
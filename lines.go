@@ -0,0 +1,54 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package pre
+
+import (
+	"strings"
+
+	"github.com/goulash/pre/ast"
+)
+
+// ProcessLines parses the file at path and calls fn for each line of the
+// result, without its newline, along with the position in the source at
+// which the line begins. The tree of the file is parsed into memory first,
+// but the output is not rendered into a single string, which is why
+// neither the Hooks nor the Filters are applied. If fn returns an error,
+// ProcessLines stops and returns it.
+func (p *Processor) ProcessLines(path string, fn func(line string, origin ast.PosInfo) error) error {
+	parser := newParser(p)
+	parser.Mmap = p.Mmap
+	defer parser.Close()
+	if err := parser.Parse(path); err != nil {
+		return err
+	}
+
+	var line strings.Builder
+	var origin ast.PosInfo
+	for _, n := range parser.Root().Nodes() {
+		s := n.String()
+		for off := 0; off < len(s); {
+			if line.Len() == 0 {
+				if pi := n.Offset(off); pi != nil {
+					origin = *pi
+				}
+			}
+			i := strings.IndexByte(s[off:], '\n')
+			if i < 0 {
+				line.WriteString(s[off:])
+				break
+			}
+			line.WriteString(s[off : off+i])
+			if err := fn(line.String(), origin); err != nil {
+				return err
+			}
+			line.Reset()
+			off += i + 1
+		}
+	}
+	if line.Len() > 0 {
+		return fn(line.String(), origin)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package pre
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/goulash/pre/ast"
+)
+
+func TestProcessLines(z *testing.T) {
+	var got []string
+	err := New().ProcessLines("testdata/parent.test", func(line string, origin ast.PosInfo) error {
+		got = append(got, fmt.Sprintf("%s: %s", origin, line))
+		return nil
+	})
+	if err != nil {
+		z.Fatal(err)
+	}
+	exp := []string{
+		"testdata/parent.test:1:1: This parent text should contain the child text, which contains:",
+		"testdata/parent.test:2:1: ",
+		"testdata/parent.test:3:1:     This is the child text, included by the parent file.",
+		"testdata/parent.test:4:1:     EOF",
+		"testdata/parent.test:5:1: ",
+		"testdata/child.test:1:1: This is the child text, included by the parent file.",
+		"testdata/child.test:2:1: EOF",
+	}
+	if !reflect.DeepEqual(got, exp) {
+		z.Errorf("ProcessLines() = %q, want %q", got, exp)
+	}
+
+	stop := errors.New("stop")
+	var n int
+	err = New().ProcessLines("testdata/parent.test", func(string, ast.PosInfo) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		z.Errorf("ProcessLines() = %v after %d lines, want %v after 1", err, n, stop)
+	}
+}
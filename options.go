@@ -0,0 +1,82 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package pre
+
+import "github.com/goulash/pre/ast"
+
+// An Option changes a setting of a Processor when it is created with New,
+// or later with Apply. Options cover the settings of ast.Options and the
+// defines; all other settings are set through the fields of the Processor,
+// which continue to work. To change settings for a single call of Parse,
+// use a ParseOption.
+type Option func(*Processor)
+
+// Apply applies the options opts to p in order. It must not be called
+// while p is used.
+func (p *Processor) Apply(opts ...Option) {
+	for _, opt := range opts {
+		opt(p)
+	}
+}
+
+// WithOptions sets the settings of o that are not the zero value, like
+// ast.WithOptions does for an ast.Parser.
+func WithOptions(o ast.Options) Option {
+	return func(p *Processor) {
+		if o.Trigger != "" {
+			p.Trigger = o.Trigger
+		}
+		if o.Commenters != nil {
+			WithCommenters(o.Commenters...)(p)
+		}
+		if o.MaxIncludeDepth != 0 {
+			p.MaxIncludeDepth = o.MaxIncludeDepth
+		}
+		if o.IncludePaths != nil {
+			p.IncludePaths = o.IncludePaths
+		}
+		if o.FS != nil {
+			p.FS = o.FS
+		}
+	}
+}
+
+// WithTrigger sets the trigger that begins directives.
+func WithTrigger(t string) Option {
+	return func(p *Processor) { p.Trigger = t }
+}
+
+// WithCommenters sets copies of the commenters, replacing any that are set,
+// so that KeepComments and StripComments do not change cs.
+func WithCommenters(cs ...*ast.Commenter) Option {
+	return func(p *Processor) {
+		p.Commenters = make(ast.Commenters, len(cs))
+		for i, c := range cs {
+			cc := *c
+			p.Commenters[i] = &cc
+		}
+	}
+}
+
+// WithMaxIncludeDepth sets the maximum depth of nested includes.
+func WithMaxIncludeDepth(n int) Option {
+	return func(p *Processor) { p.MaxIncludeDepth = n }
+}
+
+// WithIncludePaths sets the directories that are searched for files
+// included with the syntax of the C preprocessor.
+func WithIncludePaths(dirs ...string) Option {
+	return func(p *Processor) { p.IncludePaths = dirs }
+}
+
+// WithFS sets the file system that files are read from.
+func WithFS(fs ast.FileSystem) Option {
+	return func(p *Processor) { p.FS = fs }
+}
+
+// WithDefine defines the macro name with the given value, like Define.
+func WithDefine(name, value string) Option {
+	return func(p *Processor) { p.Define(name, value) }
+}
@@ -5,10 +5,25 @@
 package pre
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/goulash/osutil"
+	"github.com/goulash/pre/ast"
 )
 
 const (
@@ -88,3 +103,1894 @@ func TestSimple(z *testing.T) {
 		}
 	}
 }
+
+func TestQuotes(z *testing.T) {
+	p := New()
+	p.AddCommenter(CppComment, true)
+	p.Quotes = "\"'"
+
+	var tests = []struct {
+		Test string
+		Exp  string
+	}{
+		{"url := \"http://x\" // comment\n", "url := \"http://x\" \n"},
+		{"s := 'a\\'//' // comment\n", "s := 'a\\'//' \n"},
+		{"s := \"unterminated //\n// comment\n", "s := \"unterminated //\n\n"},
+	}
+	for _, t := range tests {
+		n, err := p.ParseString("internal", t.Test)
+		if err != nil {
+			z.Error(err)
+			continue
+		}
+		if n.String() != t.Exp {
+			z.Errorf("ParseString(%q) = %q, want %q", t.Test, n.String(), t.Exp)
+		}
+	}
+}
+
+func TestAliases(z *testing.T) {
+	p := New()
+	p.IgnoreCase = true
+	p.Aliases = map[string]string{"import": "include", "einfügen": "include", "包含": "include"}
+
+	const exp = "This is the child text, included by the parent file.\nEOF\n"
+	for _, test := range []string{
+		"#INCLUDE \"child.test\"\n",
+		"#import \"child.test\"\n",
+		"#Import \"child.test\"\n",
+		"#Einfügen \"child.test\"\n",
+		"#包含 \"child.test\"\n",
+	} {
+		n, err := p.ParseString("testdata/internal", test)
+		if err != nil {
+			z.Error(err)
+			continue
+		}
+		if n.String() != exp {
+			z.Errorf("ParseString(%q) = %q, want %q", test, n.String(), exp)
+		}
+	}
+}
+
+func TestEscapeTrigger(z *testing.T) {
+	p := New()
+	p.EscapeTrigger = true
+
+	const (
+		test = "##include \"child.test\"\n  ##error \"not an error\"\n#include \"child.test\"\n"
+		exp  = "#include \"child.test\"\n  #error \"not an error\"\n" +
+			"This is the child text, included by the parent file.\nEOF\n"
+	)
+	n, err := p.ParseString("testdata/internal", test)
+	if err != nil {
+		z.Fatal(err)
+	}
+	if n.String() != exp {
+		z.Errorf("ParseString(%q) = %q, want %q", test, n.String(), exp)
+	}
+}
+
+func TestTabWidth(z *testing.T) {
+	const test = "text\n\t\t#error \"Ä\" x\n"
+
+	var tests = []struct {
+		TabWidth int
+		Column   int
+	}{
+		{0, 15},
+		{4, 20},
+		{8, 28},
+	}
+	for _, t := range tests {
+		p := New()
+		p.TabWidth = t.TabWidth
+		_, err := p.ParseString("internal", test)
+		e, ok := err.(*ast.Error)
+		if !ok {
+			z.Errorf("ParseString(%q) error = %v, want *ast.Error", test, err)
+			continue
+		}
+		if e.PosInfo.Column != t.Column {
+			z.Errorf("TabWidth %d: column = %d, want %d", t.TabWidth, e.PosInfo.Column, t.Column)
+		}
+	}
+}
+
+func TestDefinitions(z *testing.T) {
+	const test = "#define DEBUG\n#define PORT 8080\n#define NAME \"auth\"\n#define PORT 8081\n"
+
+	parser := newParser(New())
+	if err := parser.ParseString("internal", test); err != nil {
+		z.Fatal(err)
+	}
+	if n := parser.Root().Len(); n != 0 {
+		z.Errorf("define should not produce output, got %d bytes", n)
+	}
+
+	var exp = []struct {
+		Name  string
+		Value string
+		Line  int
+	}{
+		{"DEBUG", "", 1},
+		{"NAME", "auth", 3},
+		{"PORT", "8081", 4},
+	}
+	defs := parser.Definitions()
+	if len(defs) != len(exp) {
+		z.Errorf("len(Definitions()) = %d, want %d", len(defs), len(exp))
+	}
+	for _, e := range exp {
+		m, ok := defs[e.Name]
+		if !ok {
+			z.Errorf("macro %s not defined", e.Name)
+			continue
+		}
+		if m.Value != e.Value || m.Line != e.Line {
+			z.Errorf("macro %s = %q at line %d, want %q at line %d", e.Name, m.Value, m.Line, e.Value, e.Line)
+		}
+	}
+}
+
+func TestDefinitionSources(z *testing.T) {
+	p := New()
+	p.Define("PORT", "80")
+	parser := newParser(p)
+	err := parser.ParseString("internal", "#define PORT 8080\n")
+	if err != nil {
+		z.Fatal(err)
+	}
+
+	m := parser.Definitions()["PORT"]
+	if m.Source != ast.SourceDefine || m.Line != 1 || m.Value != "8080" {
+		z.Errorf("PORT = %+v, want value 8080 from define at line 1", m)
+	}
+	if m.Prev == nil || m.Prev.Source != ast.SourceAPI || m.Prev.Value != "80" {
+		z.Errorf("PORT.Prev = %+v, want value 80 from api", m.Prev)
+	}
+}
+
+func TestRedefine(z *testing.T) {
+	const test = "#define PORT 80\n#define PORT 80\n#define PORT 8080\n"
+	var tests = []struct {
+		Redefine ast.Redefinition
+		Value    string
+		Err      string
+	}{
+		{ast.RedefineLast, "8080", ""},
+		{ast.RedefineFirst, "80", ""},
+		{ast.RedefineWarn, "8080", ""},
+		{ast.RedefineError, "80", "macro PORT redefined, previous definition at internal:2:2"},
+	}
+	for _, t := range tests {
+		p := New()
+		p.Redefine = t.Redefine
+		parser := newParser(p)
+		err := parser.ParseString("internal", test)
+		if t.Err == "" && err != nil || t.Err != "" && (err == nil || !strings.HasSuffix(err.Error(), t.Err)) {
+			z.Errorf("Redefine %d: error = %v, want %q", t.Redefine, err, t.Err)
+		}
+		if m := parser.Definitions()["PORT"]; m.Value != t.Value {
+			z.Errorf("Redefine %d: PORT = %q, want %q", t.Redefine, m.Value, t.Value)
+		}
+		if ds := parser.Diagnostics(); (t.Redefine == ast.RedefineWarn) != (len(ds) == 1) {
+			z.Errorf("Redefine %d: diagnostics = %v", t.Redefine, ds)
+		}
+
+		var buf bytes.Buffer
+		p.Diagnostics = ast.WriterSink(&buf)
+		newParser(p).ParseString("internal", test)
+		if (t.Redefine == ast.RedefineWarn) != strings.HasPrefix(buf.String(), "warning: internal:3:") {
+			z.Errorf("Redefine %d: sink received %q", t.Redefine, buf.String())
+		}
+	}
+}
+
+func TestTripleQuote(z *testing.T) {
+	const test = "A\n#define BODY \"\"\"He said \"hi\"\nand left.\"\"\"\n#define EMPTY \"\"\"\"\"\"\nB\n"
+	parser := newParser(New())
+	if err := parser.ParseString("internal", test); err != nil {
+		z.Fatal(err)
+	}
+	if s := parser.Root().String(); s != "A\nB\n" {
+		z.Errorf("output = %q, want %q", s, "A\nB\n")
+	}
+	defs := parser.Definitions()
+	if v := defs["BODY"].Value; v != "He said \"hi\"\nand left." {
+		z.Errorf("BODY = %q", v)
+	}
+	if m, ok := defs["EMPTY"]; !ok || m.Value != "" || m.Line != 4 {
+		z.Errorf("EMPTY = %+v, want empty macro at line 4", m)
+	}
+
+	_, err := New().ParseString("internal", "#define BODY \"\"\"unterminated\n")
+	if err == nil || !strings.Contains(err.Error(), "unterminated triple-quoted string") {
+		z.Errorf("ParseString() error = %v, want unterminated string", err)
+	}
+}
+
+func TestScopedInclude(z *testing.T) {
+	parser := newParser(New())
+	err := parser.ParseString("testdata/internal", "#include \"define.txt\" scoped\n#define OUTER\n")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defs := parser.Definitions()
+	if _, ok := defs["OUTER"]; !ok {
+		z.Errorf("macro OUTER should be defined")
+	}
+	if _, ok := defs["INNER"]; ok {
+		z.Errorf("macro INNER should not leak out of scoped include")
+	}
+
+	parser = newParser(New())
+	if err := parser.ParseString("testdata/internal", "#include \"define.txt\"\n"); err != nil {
+		z.Fatal(err)
+	}
+	if _, ok := parser.Definitions()["INNER"]; !ok {
+		z.Errorf("macro INNER should be defined after unscoped include")
+	}
+}
+
+func TestIncludeParameters(z *testing.T) {
+	parser := newParser(New())
+	err := parser.ParseString("testdata/internal", "#include \"child.test\" NAME=\"auth\" PORT=8080\n")
+	if err != nil {
+		z.Fatal(err)
+	}
+	if s := parser.Root().String(); s != "This is the child text, included by the parent file.\nEOF\n" {
+		z.Errorf("include with parameters = %q", s)
+	}
+	if defs := parser.Definitions(); len(defs) != 0 {
+		z.Errorf("parameters should not leak out of include, got %v", defs)
+	}
+}
+
+func TestDependencies(z *testing.T) {
+	code := "#include \"parent.test\"\n#include \"child.test\"\n#include \"checksum.test\"\n"
+	parser := newParser(New())
+	if err := parser.ParseString("testdata/internal", code); err != nil {
+		z.Fatal(err)
+	}
+	var exp []string
+	for _, name := range []string{"parent.test", "child.test", "checksum.test"} {
+		abs, err := filepath.Abs(filepath.Join("testdata", name))
+		if err != nil {
+			z.Fatal(err)
+		}
+		exp = append(exp, abs)
+	}
+	root := parser.Root()
+	if deps := root.Dependencies(); !reflect.DeepEqual(deps, exp) {
+		z.Errorf("Dependencies() = %v, want %v", deps, exp)
+	}
+	if deps := root.SortedDependencies(); !reflect.DeepEqual(deps, []string{exp[2], exp[1], exp[0]}) {
+		z.Errorf("SortedDependencies() = %v", deps)
+	}
+}
+
+func TestIndex(z *testing.T) {
+	x, err := New().Index("testdata/parent.test", "testdata/optional.test", "testdata/child.test")
+	if err != nil {
+		z.Fatal(err)
+	}
+	if files := x.Files(); len(files) != 1 {
+		z.Errorf("Index.Files() = %v, want only child.test", files)
+	}
+
+	refs := x.ReferencesTo("testdata/child.test")
+	var exp = []struct {
+		Name string
+		Line int
+	}{
+		{"testdata/parent.test", 6},
+		{"testdata/optional.test", 4},
+	}
+	if len(refs) != len(exp) {
+		z.Fatalf("ReferencesTo(child.test) = %v, want %d references", refs, len(exp))
+	}
+	for i, e := range exp {
+		if refs[i].Name != e.Name || refs[i].Line != e.Line {
+			z.Errorf("reference %d = %s, want %s:%d", i, refs[i], e.Name, e.Line)
+		}
+	}
+}
+
+func TestComments(z *testing.T) {
+	p := New()
+	p.AddCommenter(CppComment, false)
+	p.AddCommenter(CComment, false)
+
+	parser := newParser(p)
+	if err := parser.Parse("testdata/comment.test"); err != nil {
+		z.Fatal(err)
+	}
+	var exp = []struct {
+		Text      string
+		Line      int
+		Commenter *ast.Commenter
+	}{
+		{"// This C++ comment should be stripped.", 3, CppComment},
+		{"// magic number", 11, CppComment},
+		{"/*argc*/", 16, CComment},
+		{"/*argv*/", 16, CComment},
+	}
+	cs := parser.Root().CommentsByFile()["testdata/comment.test"]
+	if len(cs) != len(exp) {
+		z.Fatalf("CommentsByFile() = %d comments, want %d", len(cs), len(exp))
+	}
+	for i, e := range exp {
+		c := cs[i]
+		if c.String() != e.Text || c.Line != e.Line || c.Commenter() != e.Commenter {
+			z.Errorf("comment %d = %q at line %d, want %q at line %d", i, c, c.Line, e.Text, e.Line)
+		}
+		body := e.Text[len(e.Commenter.Begin) : len(e.Text)-len(e.Commenter.End)]
+		if c.Body() != body {
+			z.Errorf("comment %d body = %q, want %q", i, c.Body(), body)
+		}
+	}
+}
+
+func TestHeader(z *testing.T) {
+	const test = "\n// Copyright (c) 2015\n//\n/* License:\n * MIT */\n\npackage pre // comment\n"
+
+	var tests = []struct {
+		Strip  bool
+		Header string
+		Exp    string
+	}{
+		{false, "", "\n\npackage pre // comment\n"},
+		{true, "", "\n\npackage pre \n"},
+		{false, "// Generated\n", "\n// Generated\n\npackage pre // comment\n"},
+	}
+	for _, t := range tests {
+		p := New()
+		p.AddCommenter(CppComment, t.Strip)
+		p.AddCommenter(CComment, t.Strip)
+		p.HeaderLines = 4
+		p.Header = t.Header
+		n, err := p.ParseString("internal", test)
+		if err != nil {
+			z.Error(err)
+			continue
+		}
+		if n.String() != t.Exp {
+			z.Errorf("header %q, strip %v: got %q, want %q", t.Header, t.Strip, n.String(), t.Exp)
+		}
+	}
+}
+
+func TestKeepDirectives(z *testing.T) {
+	p := New()
+	p.KeepDirectives = true
+
+	n, err := p.Parse("testdata/keep.txt")
+	if err != nil {
+		z.Fatal(err)
+	}
+	const exp = "This is the child text, included by the parent file.\nEOF\n" +
+		"#include <stdio.h>\n  #define DEBUG 1\n#pragma once\n#\n" +
+		"#if defined(DEBUG) && DEBUG > 0\nint debug = 'x';\n#endif\n"
+	if n.String() != exp {
+		z.Errorf("Parse(keep.txt) = %q, want %q", n.String(), exp)
+	}
+}
+
+func TestDialectCPP(z *testing.T) {
+	p := New()
+	p.Dialect = DialectCPP
+	p.IncludePaths = []string{"testdata/does-not-exist", "testdata/include"}
+
+	n, err := p.Parse("testdata/cpp.txt")
+	if err != nil {
+		z.Fatal(err)
+	}
+	const exp = "int defs;\nThis is the child text, included by the parent file.\nEOF\n" +
+		"#pragma once\n#define MAX(a, b) \\\n\t((a) > (b) ? (a) : (b))\n#define VERSION 2\n" +
+		"#if MAX(1, 2) > 1\nint line = 8; /* __LINE__ */\n" +
+		"char *file = \"testdata/cpp.txt\", *s = \"__LINE__\", *t = MY__LINE__;\n#endif\n"
+	if n.String() != exp {
+		z.Errorf("Parse(cpp.txt) = %q, want %q", n.String(), exp)
+	}
+}
+
+func TestRanges(z *testing.T) {
+	parser := newParser(New())
+	const test = "before\n#include \"child.test\"\nafter\n"
+	if err := parser.ParseString("testdata/internal", test); err != nil {
+		z.Fatal(err)
+	}
+	root := parser.Root()
+	child := root.Dependencies()[0]
+
+	var exp = map[string][]ast.Range{
+		"testdata/internal": {{Start: 0, End: 7}, {Start: 64, End: 70}},
+		child:               {{Start: 7, End: 64}},
+	}
+	rs := root.Ranges()
+	if len(rs) != len(exp) {
+		z.Errorf("Ranges() = %v, want %v", rs, exp)
+	}
+	for k, want := range exp {
+		got := rs[k]
+		if len(got) != len(want) {
+			z.Errorf("Ranges()[%s] = %v, want %v", k, got, want)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				z.Errorf("Ranges()[%s] = %v, want %v", k, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestRaw(z *testing.T) {
+	p := New()
+	p.AddCommenter(CppComment, true)
+	p.Symbols = map[string]string{"__NAME__": "pre"}
+	code := "Hello, __NAME__!\n// stripped\n#define A 1\n"
+	nod, err := p.ParseString("testdata/internal", code)
+	if err != nil {
+		z.Fatal(err)
+	}
+	if raw := nod.(ast.Rawer).Raw(); raw != code {
+		z.Errorf("Raw() of file = %q, want %q", raw, code)
+	}
+	var raws []string
+	for _, n := range nod.(*ast.FileNode).Nodes() {
+		raws = append(raws, n.(ast.Rawer).Raw())
+	}
+	if exp := []string{"Hello, ", "__NAME__", "!\n", "\n"}; !reflect.DeepEqual(raws, exp) {
+		z.Errorf("Raw() of nodes = %q, want %q", raws, exp)
+	}
+
+	// Directives that are kept are their source.
+	p.KeepDirectives = true
+	nod, err = p.ParseString("testdata/internal", "#ifdef A\nB\n#endif")
+	if err != nil {
+		z.Fatal(err)
+	}
+	raws = raws[:0]
+	for _, n := range nod.(*ast.FileNode).Nodes() {
+		raws = append(raws, n.(ast.Rawer).Raw())
+	}
+	if exp := []string{"#ifdef A\n", "B\n", "#endif"}; !reflect.DeepEqual(raws, exp) {
+		z.Errorf("Raw() of kept directives = %q, want %q", raws, exp)
+	}
+}
+
+func TestPragma(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"root.txt":  "// a\n#include \"frag.txt\"\n// d\n#include \"deep.txt\"\n",
+		"frag.txt":  "#pragma strip-comments off\n// b\n#include \"inner.txt\"\n",
+		"inner.txt": "// c\n",
+		"deep.txt":  "#pragma max-depth 1\n#include \"inner.txt\"\n",
+	}
+	for name, s := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(s), 0644); err != nil {
+			z.Fatal(err)
+		}
+	}
+
+	p := New()
+	p.AddCommenter(CppComment, true)
+	_, err = p.Parse(filepath.Join(dir, "root.txt"))
+	if e, ok := err.(*ast.Error); !ok || e.Err != ast.ErrMaxDepthExceeded {
+		z.Errorf("Parse() error = %v, want %v", err, ast.ErrMaxDepthExceeded)
+	}
+	files["root.txt"] = "// a\n#include \"frag.txt\"\n// d\n"
+	ioutil.WriteFile(filepath.Join(dir, "root.txt"), []byte(files["root.txt"]), 0644)
+	nod, err := p.Parse(filepath.Join(dir, "root.txt"))
+	if err != nil {
+		z.Fatal(err)
+	}
+	if s, exp := nod.String(), "\n// b\n// c\n\n"; s != exp {
+		z.Errorf("Parse() = %q, want %q", s, exp)
+	}
+
+	if _, err := p.ParseString("testdata/internal", "#pragma pre 1\n#pragma requires file-access\n"); err != nil {
+		z.Error(err)
+	}
+	for _, code := range []string{
+		"#pragma once\n",
+		"#pragma max-depth 0\n",
+		"#pragma strip-comments maybe\n",
+		"#pragma pre 2\n",
+		"#pragma requires builtins\n",
+		"#pragma requires time-travel\n",
+	} {
+		if _, err := p.ParseString("testdata/internal", code); err == nil {
+			z.Errorf("ParseString(%q) succeeded, want error", code)
+		}
+	}
+	p.KeepDirectives = true
+	if nod, err := p.ParseString("testdata/internal", "#pragma once\n"); err != nil || nod.String() != "#pragma once\n" {
+		z.Errorf("ParseString() with KeepDirectives = %v, %v, want the directive", nod, err)
+	}
+}
+
+func TestBuiltins(z *testing.T) {
+	p := New()
+	p.Builtins = true
+	nod, err := p.ParseString("testdata/main.go", "// __BASENAME__ (__EXT__)\n#include \"builtins.txt\"\n")
+	if err != nil {
+		z.Fatal(err)
+	}
+	if s, exp := nod.String(), "// main.go (go)\nincluded into main.go at \"testdata/builtins.txt\":1\n"; s != exp {
+		z.Errorf("ParseString() = %q, want %q", s, exp)
+	}
+}
+
+func TestTransformers(z *testing.T) {
+	p := New()
+	p.Transformers = map[string]Filter{
+		"upper": func(bs []byte) ([]byte, error) { return bytes.ToUpper(bs), nil },
+	}
+	nod, err := p.ParseString("testdata/internal", "#include \"child.test\" via upper\n")
+	if err != nil {
+		z.Fatal(err)
+	}
+	if s, exp := nod.String(), "THIS IS THE CHILD TEXT, INCLUDED BY THE PARENT FILE.\nEOF\n"; s != exp {
+		z.Errorf("ParseString() = %q, want %q", s, exp)
+	}
+	for _, code := range []string{"#include \"child.test\" via lower\n", "#include \"child.test\" via\n"} {
+		if _, err := p.ParseString("testdata/internal", code); err == nil {
+			z.Errorf("ParseString(%q) succeeded, want error", code)
+		}
+	}
+}
+
+func TestBinary(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bin := "\x89PNG\r\n\x1a\n\x00\x00#include\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "image.png"), []byte(bin), 0644); err != nil {
+		z.Fatal(err)
+	}
+	code := "#include \"image.png\"\n"
+
+	p := New()
+	_, err = p.ParseString(filepath.Join(dir, "root.txt"), code)
+	if !errors.Is(err, ast.ErrBinary) {
+		z.Errorf("ParseString() error = %v, want %v", err, ast.ErrBinary)
+	}
+	p.Binary = ast.BinaryPassthrough
+	nod, err := p.ParseString(filepath.Join(dir, "root.txt"), code)
+	if err != nil {
+		z.Fatal(err)
+	}
+	if s := nod.String(); s != bin {
+		z.Errorf("ParseString() = %q, want %q", s, bin)
+	}
+
+	// Text that is not valid UTF-8 is not binary.
+	latin1 := filepath.Join(dir, "latin1.txt")
+	if err := ioutil.WriteFile(latin1, []byte("caf\xe9\n"), 0644); err != nil {
+		z.Fatal(err)
+	}
+	nod, err = New().Parse(latin1)
+	if err != nil {
+		z.Fatal(err)
+	}
+	if s := nod.String(); s != "caf\xe9\n" {
+		z.Errorf("Parse() = %q, want %q", s, "caf\xe9\n")
+	}
+}
+
+func TestExpandComments(z *testing.T) {
+	p := New()
+	p.Builtins = true
+	p.Symbols = map[string]string{"VERSION": "1.2"}
+	p.AddCommenter(&ast.Commenter{Begin: "/*", End: "*/", Expand: true}, false)
+	p.AddCommenter(CppComment, false)
+	code := "/* v VERSION, not VERSION_2,\n * line __LINE__\n#include \"x\" */\n// VERSION\n"
+	nod, err := p.ParseString("testdata/internal", code)
+	if err != nil {
+		z.Fatal(err)
+	}
+	exp := "/* v 1.2, not VERSION_2,\n * line 2\n#include \"x\" */\n// VERSION\n"
+	if s := nod.String(); s != exp {
+		z.Errorf("ParseString() = %q, want %q", s, exp)
+	}
+	if raw := nod.(*ast.FileNode).Comments()[0].Raw(); !strings.HasPrefix(raw, "/* v VERSION,") {
+		z.Errorf("Raw() of comment = %q, want the source", raw)
+	}
+}
+
+func TestColumnOne(z *testing.T) {
+	p := New()
+	p.AddCommenter(&ast.Commenter{Begin: "C", ColumnOne: true}, true)
+	nod, err := p.ParseString("testdata/internal", "C comment\n      CALL EXIT\nC\n")
+	if err != nil {
+		z.Fatal(err)
+	}
+	if s, exp := nod.String(), "\n      CALL EXIT\n\n"; s != exp {
+		z.Errorf("ParseString() = %q, want %q", s, exp)
+	}
+
+	// A marker of one rune at the end of the file ends the comment.
+	for _, t := range []struct {
+		Input string
+		Strip bool
+		Exp   string
+	}{
+		{"C", true, ""},
+		{"C", false, "C"},
+		{"      CALL EXIT\nC", true, "      CALL EXIT\n"},
+		{"      CALL EXIT\nC", false, "      CALL EXIT\nC"},
+	} {
+		p := New()
+		p.AddCommenter(&ast.Commenter{Begin: "C", ColumnOne: true}, t.Strip)
+		withTimeout(z, fmt.Sprintf("ParseString(%q)", t.Input), func() {
+			nod, err = p.ParseString("testdata/internal", t.Input)
+		})
+		if err != nil {
+			z.Errorf("ParseString(%q): %s", t.Input, err)
+			continue
+		}
+		if s := nod.String(); s != t.Exp {
+			z.Errorf("ParseString(%q) = %q, want %q", t.Input, s, t.Exp)
+		}
+	}
+}
+
+func TestCommentAtEOF(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.lisp")
+	if err := ioutil.WriteFile(path, []byte("(a)\n;"), 0644); err != nil {
+		z.Fatal(err)
+	}
+	for _, strip := range []bool{false, true} {
+		p := New()
+		p.AddCommenter(PrefixCommenter(";"), strip)
+		nod, err := p.Parse(path)
+		if err != nil {
+			z.Fatal(err)
+		}
+		exp := "(a)\n;"
+		if strip {
+			exp = "(a)\n"
+		}
+		if s := nod.String(); s != exp {
+			z.Errorf("Parse() = %q, want %q", s, exp)
+		}
+	}
+}
+
+func TestMessage(z *testing.T) {
+	var msgs []string
+	p := New()
+	p.Messages = func(pi ast.PosInfo, msg string) {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", pi, msg))
+	}
+	nod, err := p.ParseString("testdata/internal", "A\n#message \"halfway\"\nB\n")
+	if err != nil {
+		z.Fatal(err)
+	}
+	if s := nod.String(); s != "A\nB\n" {
+		z.Errorf("ParseString() = %q, want %q", s, "A\nB\n")
+	}
+	if exp := []string{"testdata/internal:2:2: halfway"}; !reflect.DeepEqual(msgs, exp) {
+		z.Errorf("messages = %q, want %q", msgs, exp)
+	}
+}
+
+func TestTokenErrors(z *testing.T) {
+	var tests = []struct {
+		In  string
+		Err string
+	}{
+		{"#error oops\n", "command error takes a single string argument, found identifier"},
+		{"#message \"a\" \"b\"\n", "command message takes a single string argument, found string"},
+		{"#pragma max-depth = 3\n", "unexpected '=' in arguments"},
+	}
+	for _, t := range tests {
+		_, err := New().ParseString("testdata/internal", t.In)
+		if err == nil || !strings.Contains(err.Error(), t.Err) {
+			z.Errorf("ParseString(%q) error = %v, want %q", t.In, err, t.Err)
+		}
+	}
+	if s := ast.TokenActionEnd.String(); s != "end of directive" {
+		z.Errorf("TokenActionEnd.String() = %q", s)
+	}
+}
+
+func TestFragments(z *testing.T) {
+	p := New()
+	p.SafeMode = true
+	p.RegisterFragment("prelude", "Hello from the prelude.\n")
+	nod, err := p.ParseString("testdata/internal", "#include \"<prelude>\"\n#include? \"<missing>\"\nBye.\n")
+	if err != nil {
+		z.Fatal(err)
+	}
+	if exp := "Hello from the prelude.\nBye.\n"; nod.String() != exp {
+		z.Errorf("ParseString() = %q, want %q", nod.String(), exp)
+	}
+	if deps := nod.(*ast.FileNode).Dependencies(); len(deps) != 0 {
+		z.Errorf("Dependencies() = %q, want none", deps)
+	}
+
+	_, err = p.ParseString("testdata/internal", "#include \"<missing>\"\n")
+	if !os.IsNotExist(errors.Unwrap(err)) {
+		z.Errorf("ParseString() error = %v, want not exist", err)
+	}
+}
+
+func TestMaxOutputSize(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Each level includes the next twice, doubling the output.
+	for i := 0; i < 20; i++ {
+		s := fmt.Sprintf("#include \"%d.txt\"\n#include \"%[1]d.txt\"\n", i+1)
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.txt", i)), []byte(s), 0644); err != nil {
+			z.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "20.txt"), []byte("lol\n"), 0644); err != nil {
+		z.Fatal(err)
+	}
+
+	p := New()
+	p.MaxOutputSize = 1 << 16
+	if _, err := p.Parse(filepath.Join(dir, "0.txt")); !errors.Is(err, ast.ErrOutputExceeded) {
+		z.Errorf("Parse() with MaxOutputSize error = %v, want %v", err, ast.ErrOutputExceeded)
+	}
+	p = New()
+	p.MaxExpansion = 100
+	if _, err := p.Parse(filepath.Join(dir, "0.txt")); !errors.Is(err, ast.ErrOutputExceeded) {
+		z.Errorf("Parse() with MaxExpansion error = %v, want %v", err, ast.ErrOutputExceeded)
+	}
+	if _, err := p.Parse(filepath.Join(dir, "19.txt")); err != nil {
+		z.Errorf("Parse() of small file = %v, want no error", err)
+	}
+}
+
+func TestMapFS(z *testing.T) {
+	p := New()
+	p.FS = ast.MapFS{
+		"/main.txt":   "#include \"lib/a.txt\"\n",
+		"/lib/a.txt":  "A\n#include \"b.txt\"\n",
+		"/lib/b.txt":  "B\n",
+		"/unused.txt": "unused\n",
+	}
+	nod, err := p.Parse("main.txt")
+	if err != nil {
+		z.Fatal(err)
+	}
+	if s := nod.String(); s != "A\nB\n" {
+		z.Errorf("Parse() = %q, want %q", s, "A\nB\n")
+	}
+	if _, err := p.ParseString("main.txt", "#include \"missing.txt\"\n"); !errors.Is(err, os.ErrNotExist) {
+		z.Errorf("ParseString() error = %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestIncludeDirs(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	parts := filepath.Join(dir, "parts")
+	if err := os.MkdirAll(filepath.Join(parts, "sub"), 0755); err != nil {
+		z.Fatal(err)
+	}
+	for name, s := range map[string]string{"b.txt": "B\n", "a.txt": "A\n", "sub/c.txt": "C\n"} {
+		if err := ioutil.WriteFile(filepath.Join(parts, name), []byte(s), 0644); err != nil {
+			z.Fatal(err)
+		}
+	}
+	main := filepath.Join(dir, "main.txt")
+	if err := ioutil.WriteFile(main, []byte("#include \"parts\"\n"), 0644); err != nil {
+		z.Fatal(err)
+	}
+
+	p := New()
+	if _, err := p.Parse(main); !errors.Is(err, ast.ErrIsDir) {
+		z.Errorf("Parse() error = %v, want %v", err, ast.ErrIsDir)
+	}
+	p.IncludeDirs = true
+	nod, err := p.Parse(main)
+	if err != nil {
+		z.Fatal(err)
+	}
+	if s := nod.String(); s != "A\nB\n" {
+		z.Errorf("Parse() = %q, want %q", s, "A\nB\n")
+	}
+
+	p.FS = ast.MapFS{
+		"/main.txt":        "#include \"parts\"\n",
+		"/parts/b.txt":     "B\n",
+		"/parts/a.txt":     "A\n",
+		"/parts/sub/c.txt": "C\n",
+	}
+	nod, err = p.Parse("main.txt")
+	if err != nil {
+		z.Fatal(err)
+	}
+	if s := nod.String(); s != "A\nB\n" {
+		z.Errorf("Parse() with MapFS = %q, want %q", s, "A\nB\n")
+	}
+}
+
+func TestClone(z *testing.T) {
+	base := New()
+	base.AddCommenter(&ast.Commenter{Begin: "//"}, false)
+	base.Symbols = map[string]string{"NAME": "base"}
+	base.Define("A", "1")
+	base.Quoting = &ast.Quoting{Quotes: `"`}
+
+	q := base.Clone()
+	q.Define("B", "2")
+	q.Symbols["NAME"] = "request"
+	q.Commenters[0].Strip = true
+	q.Quoting.Quotes = `'`
+
+	if len(base.Defines) != 1 || base.Symbols["NAME"] != "base" || base.Commenters[0].Strip || base.Quoting.Quotes != `"` {
+		z.Errorf("Clone() shares state with the original: %v, %v, %v, %v", base.Defines, base.Symbols, base.Commenters[0], base.Quoting)
+	}
+	nod, err := q.ParseString("testdata/internal", "// gone\nNAME\n")
+	if err != nil {
+		z.Fatal(err)
+	}
+	if s := nod.String(); s != "\nrequest\n" {
+		z.Errorf("ParseString() = %q, want %q", s, "\nrequest\n")
+	}
+}
+
+func TestQuoting(z *testing.T) {
+	var tests = []struct {
+		Quoting *ast.Quoting
+		In      string
+		Exp     string
+	}{
+		{nil, `#message "a\"b"`, `a\"b`},
+		{ast.RawQuoting, `#message "C:\dir\"`, `C:\dir\`},
+		{ast.RawQuoting, `#message 'say "hi"'`, `say "hi"`},
+		{ast.GoQuoting, `#message "a\tb"`, "a\tb"},
+		{ast.GoQuoting, `#message """a\tb"""`, `a\tb`},
+		{ast.JSONQuoting, `#message "caf\u00e9"`, "café"},
+	}
+	for _, t := range tests {
+		var got string
+		p := New()
+		p.Quoting = t.Quoting
+		p.Messages = func(pi ast.PosInfo, msg string) { got = msg }
+		if _, err := p.ParseString("testdata/internal", t.In+"\n"); err != nil {
+			z.Errorf("ParseString(%q): %v", t.In, err)
+			continue
+		}
+		if got != t.Exp {
+			z.Errorf("ParseString(%q) message = %q, want %q", t.In, got, t.Exp)
+		}
+	}
+
+	p := New()
+	p.Quoting = ast.GoQuoting
+	if _, err := p.ParseString("testdata/internal", `#message "\q"`+"\n"); err == nil || !strings.Contains(err.Error(), "invalid escape") {
+		z.Errorf("ParseString() error = %v, want invalid escape", err)
+	}
+}
+
+func TestCommands(z *testing.T) {
+	var got []string
+	p := New()
+	p.Commands = func(c ast.Command) {
+		got = append(got, fmt.Sprintf("%s: %s", c.PosInfo, c))
+	}
+	p.Messages = func(ast.PosInfo, string) {}
+	code := "#define A \"1\"\n#include? \"missing.txt\" optional=true\n#pragma max-depth 8\n#message \"done\"\n"
+	if _, err := p.ParseString("testdata/internal", code); err != nil {
+		z.Fatal(err)
+	}
+	exp := []string{
+		`testdata/internal:1:2: define A "1"`,
+		`testdata/internal:2:9: include? "missing.txt" optional=true`,
+		`testdata/internal:3:2: pragma max-depth 8`,
+		`testdata/internal:4:2: message "done"`,
+	}
+	if !reflect.DeepEqual(got, exp) {
+		z.Errorf("commands = %q, want %q", got, exp)
+	}
+}
+
+func TestStats(z *testing.T) {
+	p := New()
+	p.Stats = ast.NewStats()
+	for i := 0; i < 2; i++ {
+		if _, err := p.Parse("testdata/parent.test"); err != nil {
+			z.Fatal(err)
+		}
+	}
+	fs := p.Stats.Files()
+	if len(fs) != 2 {
+		z.Fatalf("Files() = %v, want parent and child", fs)
+	}
+	var total time.Duration
+	for _, f := range fs {
+		if base := filepath.Base(f.Path); base != "parent.test" && base != "child.test" {
+			z.Errorf("Files() has %s", f.Path)
+		}
+		if f.Reads != 2 || f.Read < 0 || f.Parse < 0 {
+			z.Errorf("file %s: %+v", f.Path, f)
+		}
+		total += f.Total()
+	}
+	if p.Stats.Total() != total {
+		z.Errorf("Total() = %v, want %v", p.Stats.Total(), total)
+	}
+}
+
+func TestMetrics(z *testing.T) {
+	p := New()
+	p.Metrics = ast.NewMetrics()
+	p.FS = ast.MapFS{
+		"/root.txt": "#define A \"1\"\n#include \"a.txt\"\n#include \"a.txt\"\n",
+		"/a.txt":    "#message \"a\"\n",
+	}
+	p.Messages = func(ast.PosInfo, string) {}
+	if _, err := p.Parse("/root.txt"); err != nil {
+		z.Fatal(err)
+	}
+	exp := []ast.CommandCount{
+		{Name: "define", File: "/root.txt", Count: 1},
+		{Name: "include", File: "/root.txt", Count: 2},
+		{Name: "message", File: "/a.txt", Count: 2},
+	}
+	if cs := p.Metrics.Counts(); !reflect.DeepEqual(cs, exp) {
+		z.Errorf("Counts() = %v, want %v", cs, exp)
+	}
+	if n := p.Metrics.Commands()["include"]; n != 2 {
+		z.Errorf("Commands()[include] = %d, want 2", n)
+	}
+
+	var buf bytes.Buffer
+	if err := p.Metrics.WritePrometheus(&buf); err != nil {
+		z.Fatal(err)
+	}
+	line := `pre_commands_total{command="message",file="/a.txt"} 2`
+	if !strings.Contains(buf.String(), line+"\n") {
+		z.Errorf("WritePrometheus() = %q, want line %q", buf.String(), line)
+	}
+}
+
+func TestValidate(z *testing.T) {
+	p := New()
+	p.Diagnostics = ast.DiagnosticsFunc(func(d ast.Diagnostic) {
+		z.Errorf("diagnostic %s passed to Diagnostics", d)
+	})
+	if ds := p.Validate("testdata/parent.test"); len(ds) != 0 {
+		z.Errorf("Validate() = %v, want none", ds)
+	}
+	ds := p.Validate("testdata/error.txt")
+	exp := []ast.Diagnostic{{
+		PosInfo: ast.PosInfo{Name: "testdata/error.txt", Line: 1, Column: 35},
+		Code:    "error",
+		Message: "choose your error message",
+	}}
+	if !reflect.DeepEqual(ds, exp) {
+		z.Errorf("Validate() = %v, want %v", ds, exp)
+	}
+}
+
+func TestProcessCommand(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, s := range map[string]string{
+		"q.sql":    "-- kept\n%include \"part.sql\"\n#not a directive\n",
+		"part.sql": "SELECT 1;\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(s), 0644); err != nil {
+			z.Fatal(err)
+		}
+	}
+
+	p := New()
+	p.AddCommenter(CppComment, true)
+	code := "// gone\nA\n#process \"q.sql\" with trigger \"%\" comment \"--\"\nB\n"
+	nod, err := p.ParseString(filepath.Join(dir, "main.txt"), code)
+	if err != nil {
+		z.Fatal(err)
+	}
+	if exp := "\nA\n-- kept\nSELECT 1;\n#not a directive\nB\n"; nod.String() != exp {
+		z.Errorf("ParseString() = %q, want %q", nod.String(), exp)
+	}
+	deps := nod.(*ast.FileNode).Dependencies()
+	if len(deps) != 2 || filepath.Base(deps[0]) != "q.sql" || filepath.Base(deps[1]) != "part.sql" {
+		z.Errorf("Dependencies() = %q, want q.sql and part.sql", deps)
+	}
+
+	// A comment that begins in the middle of a line.
+	if err := ioutil.WriteFile(filepath.Join(dir, "q.c"), []byte("x {\n#include \"nope\"\n}\ny\n"), 0644); err != nil {
+		z.Fatal(err)
+	}
+	nod, err = p.ParseString(filepath.Join(dir, "main.txt"), "#process \"q.c\" with comment \"{\" \"}\"\n")
+	if err != nil {
+		z.Fatal(err)
+	}
+	if exp := "x {\n#include \"nope\"\n}\ny\n"; nod.String() != exp {
+		z.Errorf("ParseString() = %q, want %q", nod.String(), exp)
+	}
+
+	for _, bad := range []string{`#process`, `#process "q.sql" trigger "%"`, `#process "q.sql" with color "red"`} {
+		if _, err := p.ParseString(filepath.Join(dir, "main.txt"), bad+"\n"); err == nil {
+			z.Errorf("ParseString(%q) did not fail", bad)
+		}
+	}
+}
+
+func TestStrictUTF8(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "bad.txt"), []byte("ok\nab\xffc\n"), 0644); err != nil {
+		z.Fatal(err)
+	}
+
+	p := New()
+	p.StrictUTF8 = true
+	p.Binary = ast.BinaryPassthrough
+	root := filepath.Join(dir, "root.txt")
+	_, err = p.ParseString(root, "A\n#include \"bad.txt\"\n")
+	if !errors.Is(err, ast.ErrInvalidUTF8) {
+		z.Fatalf("ParseString() error = %v, want %v", err, ast.ErrInvalidUTF8)
+	}
+	e := err.(*ast.Error)
+	if e.PosInfo.Line != 2 || e.PosInfo.Column != 3 || filepath.Base(e.PosInfo.Name) != "bad.txt" {
+		z.Errorf("error at %s, want bad.txt:2:3", e.PosInfo)
+	}
+	if len(e.Includes) != 1 || e.Includes[0].Line != 2 {
+		z.Errorf("error included from %v, want line 2 of the root", e.Includes)
+	}
+
+	if _, err := p.ParseString(root, "\xfe"); !errors.Is(err, ast.ErrInvalidUTF8) {
+		z.Errorf("ParseString() error = %v, want %v", err, ast.ErrInvalidUTF8)
+	}
+}
+
+func TestIncludeMap(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"std/strings.txt": "strings\n",
+		"prod.conf":       "prod\n",
+		"map.json":        `{"stdlib/": "std", "config": "prod.conf"}`,
+	}
+	os.Mkdir(filepath.Join(dir, "std"), 0755)
+	for name, s := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(s), 0644); err != nil {
+			z.Fatal(err)
+		}
+	}
+
+	p := New()
+	if err := p.LoadIncludeMap(filepath.Join(dir, "map.json")); err != nil {
+		z.Fatal(err)
+	}
+	nod, err := p.ParseString("testdata/internal", "#include \"stdlib/strings.txt\"\n#include \"config\"\n#include \"child.test\"\n")
+	if err != nil {
+		z.Fatal(err)
+	}
+	if s, exp := nod.String(), "strings\nprod\nThis is the child text, included by the parent file.\nEOF\n"; s != exp {
+		z.Errorf("ParseString() = %q, want %q", s, exp)
+	}
+}
+
+func TestCommentDirective(z *testing.T) {
+	p := New()
+	p.AddCommenter(&ast.Commenter{Begin: "/*", End: "*/", Directive: "pre:"}, false)
+	p.AddCommenter(&ast.Commenter{Begin: "//", Directive: "pre:"}, false)
+	code := "/* pre:include \"child.test\" */\nA /* a comment */\n//  pre:define X 1\nB\n"
+	nod, err := p.ParseString("testdata/internal", code)
+	if err != nil {
+		z.Fatal(err)
+	}
+	exp := "This is the child text, included by the parent file.\nEOF\nA /* a comment */\nB\n"
+	if s := nod.String(); s != exp {
+		z.Errorf("ParseString() = %q, want %q", s, exp)
+	}
+	_, err = p.ParseString("testdata/internal", "/* pre:foo */\n")
+	if err == nil || !strings.HasSuffix(err.Error(), "testdata/internal:1:8: unknown command foo") {
+		z.Errorf("ParseString() error = %v, want unknown command at 1:8", err)
+	}
+
+	// Only comment directives end at the End of their Commenter.
+	p.KeepDirectives = true
+	code = "#if A */ B\nC\n"
+	nod, err = p.ParseString("testdata/internal", code)
+	if err != nil {
+		z.Fatal(err)
+	}
+	if s := nod.String(); s != code {
+		z.Errorf("ParseString() = %q, want %q", s, code)
+	}
+}
+
+func TestNoFinalNewline(z *testing.T) {
+	p := New()
+	p.KeepDirectives = true
+	for _, test := range []struct{ Code, Exp string }{
+		{"A\n#include \"child.test\"", "A\nThis is the child text, included by the parent file.\nEOF\n"},
+		{"A\n#define X 1", "A\n#define X 1"},
+		{"A\n#error \"no newline\"", ""},
+	} {
+		nod, err := p.ParseString("testdata/internal", test.Code)
+		if test.Exp == "" {
+			if e, ok := err.(*ast.Error); !ok || e.Err.Error() != "no newline" {
+				z.Errorf("ParseString(%q) error = %v, want no newline", test.Code, err)
+			}
+		} else if err != nil {
+			z.Errorf("ParseString(%q) error = %v", test.Code, err)
+		} else if s := nod.String(); s != test.Exp {
+			z.Errorf("ParseString(%q) = %q, want %q", test.Code, s, test.Exp)
+		}
+	}
+}
+
+func TestRequireCache(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, s string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(s), 0644); err != nil {
+			z.Fatal(err)
+		}
+	}
+	write("prelude.txt", "#define X 1\n#require \"types.txt\"\nprelude\n")
+	write("types.txt", "types\n")
+	write("a.txt", "#require \"prelude.txt\"\na\n")
+	write("b.txt", "#require \"types.txt\"\n#require \"prelude.txt\"\nb\n")
+
+	p := New()
+	p.RequireCache = ast.NewRequireCache()
+	prelude := func(path string) ast.Node {
+		nod, err := p.Parse(filepath.Join(dir, path))
+		if err != nil {
+			z.Fatal(err)
+		}
+		return nod.(*ast.FileNode).Nodes()[0]
+	}
+	first := prelude("a.txt")
+	if n := prelude("a.txt"); n != first {
+		z.Errorf("prelude was parsed again, want it shared")
+	}
+	nod, err := p.Parse(filepath.Join(dir, "b.txt"))
+	if err != nil {
+		z.Fatal(err)
+	}
+	if s := nod.String(); s != "types\nprelude\nb\n" {
+		z.Errorf("Parse() = %q, want types only once", s)
+	}
+	write("prelude.txt", "changed\n")
+	if n := prelude("a.txt"); n == first || n.String() != "changed\n" {
+		z.Errorf("changed prelude = %q, want it parsed again", n.String())
+	}
+}
+
+func TestPlatformBuiltins(z *testing.T) {
+	p := New()
+	code := "__GOOS__/__GOARCH__ __FILE__\n"
+	nod, err := p.ParseString("testdata/internal", code)
+	if err != nil {
+		z.Fatal(err)
+	}
+	if s := nod.String(); s != code {
+		z.Errorf("ParseString() = %q, want %q", s, code)
+	}
+	p.PlatformBuiltins = true
+	nod, err = p.ParseString("testdata/internal", code)
+	if err != nil {
+		z.Fatal(err)
+	}
+	if exp := runtime.GOOS + "/" + runtime.GOARCH + " __FILE__\n"; nod.String() != exp {
+		z.Errorf("ParseString() = %q, want %q", nod.String(), exp)
+	}
+
+	// They reveal the machine, so neither SafeMode nor ParseUntrusted
+	// replaces them.
+	code = "__HOSTNAME__ __USER__\n"
+	nod, err = p.ParseUntrusted("testdata/internal", code)
+	if err != nil {
+		z.Fatal(err)
+	}
+	if s := nod.String(); s != code {
+		z.Errorf("ParseUntrusted() = %q, want %q", s, code)
+	}
+	p.SafeMode = true
+	nod, err = p.ParseString("testdata/internal", code)
+	if err != nil {
+		z.Fatal(err)
+	}
+	if s := nod.String(); s != code {
+		z.Errorf("ParseString() in SafeMode = %q, want %q", s, code)
+	}
+}
+
+func TestDeterministic(z *testing.T) {
+	p := New()
+	p.PlatformBuiltins = true
+	p.Defines = []ast.Macro{
+		{Name: "HOME", Value: "/home/a", Source: ast.SourceEnvironment},
+		{Name: "GOFILE", Value: "a.go", Source: ast.SourceEnvironment},
+		{Name: "MODE", Value: "release", Source: ast.SourceAPI},
+	}
+	p.Deterministic = true
+	p.AllowEnv = []string{"GOFILE"}
+	parser := newParser(p)
+	if err := parser.ParseString("testdata/internal", "__GOOS__ __USER__\n"); err != nil {
+		z.Fatal(err)
+	}
+	if s, exp := parser.Root().String(), "__GOOS__ __USER__\n"; s != exp {
+		z.Errorf("ParseString() = %q, want %q", s, exp)
+	}
+	defs := parser.Definitions()
+	for name, exp := range map[string]bool{"HOME": false, "GOFILE": true, "MODE": true} {
+		if _, ok := defs[name]; ok != exp {
+			z.Errorf("macro %s defined = %t, want %t", name, ok, exp)
+		}
+	}
+}
+
+func TestFate(z *testing.T) {
+	p := New()
+	p.AddCommenter(CppComment, true)
+	p.Builtins = true
+	code := "A __LINE__ // stripped\n#include \"child.test\"\nB\n"
+	nod, err := p.ParseString("testdata/internal", code)
+	if err != nil {
+		z.Fatal(err)
+	}
+	if f := nod.(*ast.FileNode).Fate("testdata/internal", 1, 1); f != ast.FateUnknown {
+		z.Errorf("Fate() without Fates = %s, want %s", f, ast.FateUnknown)
+	}
+	p.Fates = true
+	nod, err = p.ParseString("testdata/internal", code)
+	if err != nil {
+		z.Fatal(err)
+	}
+	root := nod.(*ast.FileNode)
+	for _, t := range []struct {
+		Name      string
+		Line, Col int
+		Fate      ast.Fate
+	}{
+		{"testdata/internal", 1, 1, ast.FateEmitted},
+		{"testdata/internal", 1, 4, ast.FateReplaced},
+		{"testdata/internal", 1, 15, ast.FateStripped},
+		{"testdata/internal", 2, 3, ast.FateRemoved},
+		{"testdata/internal", 3, 1, ast.FateEmitted},
+		{"testdata/internal", 3, 5, ast.FateUnknown},
+		{"testdata/child.test", 1, 5, ast.FateEmitted},
+		{"testdata/parent.test", 1, 1, ast.FateUnknown},
+	} {
+		if f := root.Fate(t.Name, t.Line, t.Col); f != t.Fate {
+			z.Errorf("Fate(%s, %d, %d) = %s, want %s", t.Name, t.Line, t.Col, f, t.Fate)
+		}
+	}
+}
+
+func TestSafeMode(z *testing.T) {
+	p := New()
+	p.SafeMode = true
+
+	for _, test := range []string{
+		"#include \"child.test\"\n",
+		"#include? \"does-not-exist.txt\"\n",
+		"#require \"child.test\"\n",
+	} {
+		_, err := p.ParseString("testdata/internal", test)
+		if e, ok := err.(*ast.Error); !ok || e.Err != ast.ErrSafeMode {
+			z.Errorf("ParseString(%q) error = %v, want %v", test, err, ast.ErrSafeMode)
+		}
+	}
+	if _, err := p.ParseString("testdata/internal", "No commands here.\n"); err != nil {
+		z.Error(err)
+	}
+}
+
+func TestParseUntrusted(z *testing.T) {
+	p := New()
+	p.MaxSteps = 100
+	var tests = []struct {
+		Code string
+		Err  error
+	}{
+		{"#include \"child.test\"\n", ast.ErrSafeMode},
+		{strings.Repeat("x", UntrustedMaxSize+1), ErrInputTooLarge},
+		{strings.Repeat("#define A 1\n", 100), ast.ErrBudgetExceeded},
+		{"#foo\n", nil},
+	}
+	for _, t := range tests {
+		nod, err := p.ParseUntrusted("testdata/upload", t.Code)
+		e, ok := err.(*ast.Error)
+		if !ok || nod != nil {
+			z.Errorf("ParseUntrusted(%.20q) = %v, %v, want nil tree and *ast.Error", t.Code, nod, err)
+		} else if t.Err != nil && !errors.Is(e.Err, t.Err) {
+			z.Errorf("ParseUntrusted(%.20q) error = %v, want %v", t.Code, err, t.Err)
+		}
+	}
+	if nod, err := p.ParseUntrusted("testdata/upload", "Some text.\n"); err != nil || nod.String() != "Some text.\n" {
+		z.Errorf("ParseUntrusted() = %v, %v, want the text", nod, err)
+	}
+
+	// Trusted symbols cannot be used to multiply the input.
+	p = New()
+	p.Symbols = map[string]string{"X": strings.Repeat("x", 1000)}
+	_, err := p.ParseUntrusted("testdata/upload", strings.Repeat("X\n", 100))
+	if !errors.Is(err, ast.ErrOutputExceeded) {
+		z.Errorf("ParseUntrusted() error = %v, want %v", err, ast.ErrOutputExceeded)
+	}
+}
+
+// withTimeout calls fn and fails if it does not return within a second.
+func withTimeout(z *testing.T, name string, fn func()) {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		z.Fatalf("%s did not return", name)
+	}
+}
+
+func TestParseUntrustedCommentAtEOF(z *testing.T) {
+	for _, t := range []struct {
+		Begin string
+		Code  string
+	}{
+		{";", ";"},
+		{";", "a\n;"},
+		{"//", "// x"},
+	} {
+		for _, header := range []int{0, 1} {
+			p := New()
+			p.AddCommenter(&ast.Commenter{Begin: t.Begin}, false)
+			p.HeaderLines = header
+			withTimeout(z, fmt.Sprintf("ParseUntrusted(%q)", t.Code), func() {
+				nod, err := p.ParseUntrusted("testdata/upload", t.Code)
+				if err != nil {
+					z.Errorf("ParseUntrusted(%q) error = %v", t.Code, err)
+				} else if header == 0 && nod.String() != t.Code {
+					z.Errorf("ParseUntrusted(%q) = %q", t.Code, nod.String())
+				}
+			})
+		}
+	}
+}
+
+func TestMaxSteps(z *testing.T) {
+	p := New()
+	p.MaxSteps = 10
+
+	_, err := p.ParseString("testdata/internal", strings.Repeat("#define X\n", 3))
+	if err != nil {
+		z.Error(err)
+	}
+	_, err = p.ParseString("testdata/internal", strings.Repeat("#define X\n", 10))
+	if e, ok := err.(*ast.Error); !ok || e.Err != ast.ErrBudgetExceeded {
+		z.Errorf("ParseString error = %v, want %v", err, ast.ErrBudgetExceeded)
+	}
+}
+
+func TestIncludeGraph(z *testing.T) {
+	g, err := New().IncludeGraph("testdata/parent.test", "testdata/checksum.test")
+	if err != nil {
+		z.Fatal(err)
+	}
+	if len(g.Files) != 3 {
+		z.Errorf("IncludeGraph().Files = %v, want 3 files", g.Files)
+	}
+	var exp = []struct {
+		Kind string
+		Line int
+	}{
+		{"include", 6},
+		{"require", 2},
+	}
+	if len(g.Edges) != len(exp) {
+		z.Fatalf("IncludeGraph().Edges = %v, want %d edges", g.Edges, len(exp))
+	}
+	for i, e := range exp {
+		edge := g.Edges[i]
+		if edge.Kind != e.Kind || edge.Pos.Line != e.Line || edge.To != g.Files[1] {
+			z.Errorf("edge %d = %v, want %s of %s at line %d", i, edge, e.Kind, g.Files[1], e.Line)
+		}
+	}
+
+	parent, child, checksum := g.Files[0], g.Files[1], g.Files[2]
+	if roots := g.Affected("testdata/child.test"); !reflect.DeepEqual(roots, []string{parent, checksum}) {
+		z.Errorf("Affected(child) = %v, want parent and checksum", roots)
+	}
+	if roots := g.Affected(parent); !reflect.DeepEqual(roots, []string{parent}) {
+		z.Errorf("Affected(parent) = %v, want parent", roots)
+	}
+	if files := g.Sort(); !reflect.DeepEqual(files, []string{child, parent, checksum}) {
+		z.Errorf("Sort() = %v, want child, parent, checksum", files)
+	}
+
+	var buf bytes.Buffer
+	if err := g.WriteDOT(&buf); err != nil {
+		z.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "digraph includes {\n") {
+		z.Errorf("WriteDOT() = %q", buf.String())
+	}
+}
+
+func TestMaxTokenSize(z *testing.T) {
+	p := New()
+	p.AddCommenter(CppComment, false)
+	p.MaxTokenSize = 4
+
+	const text = "aäääb\nc\n#include \"testdata/child.test\"\n"
+	parser := newParser(p)
+	if err := parser.ParseString("internal", text); err != nil {
+		z.Fatal(err)
+	}
+	root := parser.Root()
+	if got, exp := root.String(), "aäääb\nc\n"+"This is the child text, included by the parent file.\nEOF\n"; got != exp {
+		z.Errorf("got %q, want %q", got, exp)
+	}
+	for _, n := range root.Nodes() {
+		if n.Len() > p.MaxTokenSize || !utf8.ValidString(n.String()) {
+			z.Errorf("node %q exceeds MaxTokenSize or splits a rune", n.String())
+		}
+	}
+
+	_, err := p.ParseString("internal", "// long comment\n")
+	if err == nil || !strings.Contains(err.Error(), "exceeds maximum token size") {
+		z.Errorf("ParseString() error = %v, want token size error", err)
+	}
+}
+
+func TestNameBase(z *testing.T) {
+	p := New()
+	p.NameBase = "testdata"
+	p.SlashNames = true
+	nod, err := p.Parse("testdata/parent.test")
+	if err != nil {
+		z.Fatal(err)
+	}
+	nodes := nod.(*ast.FileNode).Nodes()
+	if n := nodes[0].Pos().Name; n != "parent.test" {
+		z.Errorf("name of parent = %q, want parent.test", n)
+	}
+	if n := nodes[len(nodes)-1].Pos().Name; n != "child.test" {
+		z.Errorf("name of child = %q, want child.test", n)
+	}
+
+	p.NameBase = filepath.Dir(filepath.Dir("testdata/copy/child.test"))
+	_, err = p.ParseString("testdata/copy/internal", "#include \"missing.txt\"\n")
+	if e, ok := err.(*ast.Error); !ok || e.PosInfo.Name != "copy/internal" {
+		z.Errorf("ParseString() error = %v, want error in copy/internal", err)
+	}
+}
+
+var errorTests = []struct {
+	Test string
+	Err  string
+}{
+	{"#require \"child.test\" sha256 \"0000\"\n", "checksum mismatch"},
+	{"#include \"does-not-exist.txt\" optional=false\n", "no such file"},
+	{"#include \"child.test\" NAME=auth\n", "must be a string, number, or bool"},
+	{"#include \"child.test\" optional=1\n", "expecting a bool"},
+	{"#include \"child.test\" optional=2x\n", "malformed number"},
+	{"#include \"child.test\" \"parent.test\"\n", "separated by or"},
+	{"#include \"child.test\" or\n", "expects a string after or"},
+	{"#define \"NAME\"\n", "takes a name and an optional value"},
+	{"#define NAME VALUE\n", "must be a string, number, or bool"},
+}
+
+func TestErrors(z *testing.T) {
+	p := New()
+
+	for _, t := range errorTests {
+		_, err := p.ParseString("testdata/internal", t.Test)
+		if err == nil {
+			z.Errorf("ParseString(%q) succeeded, want error containing %q", t.Test, t.Err)
+			continue
+		}
+		if !strings.Contains(err.Error(), t.Err) {
+			z.Errorf("ParseString(%q) error = %q, want error containing %q", t.Test, err, t.Err)
+		}
+	}
+}
+
+func TestIncludeChain(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"a.txt": "A\n#include \"b.txt\"\n",
+		"b.txt": "B\n\n#foo\n",
+	}
+	for name, s := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(s), 0644); err != nil {
+			z.Fatal(err)
+		}
+	}
+
+	root := filepath.Join(dir, "root")
+	_, err = New().ParseString(root, "\n\n#include \"a.txt\"\n")
+	e, ok := err.(*ast.Error)
+	if !ok {
+		z.Fatalf("ParseString() error = %v, want *ast.Error", err)
+	}
+	if e.PosInfo.Name != filepath.Join(dir, "b.txt") || e.PosInfo.Line != 3 {
+		z.Errorf("error at %s, want %s:3", e.PosInfo, filepath.Join(dir, "b.txt"))
+	}
+	if len(e.Includes) != 2 || e.Includes[0].Line != 2 || e.Includes[1].Name != root || e.Includes[1].Line != 3 {
+		z.Errorf("error included from %v, want a.txt:2 and root:3", e.Includes)
+	}
+	if !strings.Contains(e.Error(), ", included from "+filepath.Join(dir, "a.txt")+":2:") {
+		z.Errorf("Error() = %q, want chain of includes", e.Error())
+	}
+}
+
+func TestIncludePaths(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.txt", "A.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("A\n"), 0644); err != nil {
+			z.Fatal(err)
+		}
+	}
+
+	// Absolute paths are not relative to the including file.
+	abs, err := filepath.Abs("testdata/child.test")
+	if err != nil {
+		z.Fatal(err)
+	}
+	test := fmt.Sprintf("#include %q\n", filepath.ToSlash(abs))
+	nod, err := New().ParseString(filepath.Join(dir, "root"), test)
+	if err != nil {
+		z.Fatal(err)
+	}
+	if got, exp := nod.String(), "This is the child text, included by the parent file.\nEOF\n"; got != exp {
+		z.Errorf("include of absolute path = %q, want %q", got, exp)
+	}
+
+	const code = "#require \"a.txt\"\n#require \"A.txt\"\n"
+	for _, fold := range []bool{false, true} {
+		p := New()
+		p.FoldCase = fold
+		nod, err := p.ParseString(filepath.Join(dir, "root"), code)
+		if err != nil {
+			z.Fatal(err)
+		}
+		exp := "A\nA\n"
+		if fold {
+			exp = "A\n"
+		}
+		if got := nod.String(); got != exp {
+			z.Errorf("FoldCase %v: got %q, want %q", fold, got, exp)
+		}
+	}
+}
+
+func TestSymlinks(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "root"), 0755); err != nil {
+		z.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "outside.txt"), []byte("A\n"), 0644); err != nil {
+		z.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "outside.txt"), filepath.Join(dir, "root", "link.txt")); err != nil {
+		z.Skip(err)
+	}
+
+	const code = "#require \"link.txt\"\n#require \"../outside.txt\"\n"
+	var tests = []struct {
+		Symlinks ast.SymlinkPolicy
+		Output   string
+		Err      error
+	}{
+		{ast.SymlinksFollow, "A\n", nil},
+		{ast.SymlinksKeep, "A\nA\n", nil},
+		{ast.SymlinksConfined, "", ast.ErrSymlinkEscape},
+	}
+	for _, t := range tests {
+		parser := newParser(New())
+		parser.Symlinks = t.Symlinks
+		err := parser.ParseString(filepath.Join(dir, "root", "main.txt"), code)
+		if t.Err != nil {
+			if e, ok := err.(*ast.Error); !ok || !errors.Is(e.Err, t.Err) {
+				z.Errorf("Symlinks %d: error = %v, want %v", t.Symlinks, err, t.Err)
+			}
+			continue
+		}
+		if err != nil {
+			z.Errorf("Symlinks %d: %v", t.Symlinks, err)
+			continue
+		}
+		if got := parser.Root().String(); got != t.Output {
+			z.Errorf("Symlinks %d: got %q, want %q", t.Symlinks, got, t.Output)
+		}
+		if ds := parser.Diagnostics(); len(ds) != 0 {
+			z.Errorf("Symlinks %d: unexpected diagnostics %v", t.Symlinks, ds)
+		}
+	}
+}
+
+func TestRequireByContent(z *testing.T) {
+	const code = "#require \"child.test\"\n#require \"copy/child.test\"\n"
+
+	p := New()
+	n, err := p.ParseString("testdata/internal", code)
+	if err != nil {
+		z.Fatal(err)
+	}
+	full := n.String()
+
+	p.RequireByContent = true
+	n, err = p.ParseString("testdata/internal", code)
+	if err != nil {
+		z.Fatal(err)
+	}
+	if 2*n.Len() != len(full) {
+		z.Errorf("require by content = %q, want only one copy of %q", n.String(), full)
+	}
+}
+
+func TestSymbols(z *testing.T) {
+	p := New()
+	p.AddCommenter(CppComment, false)
+	p.Quotes = `"`
+	p.Symbols = map[string]string{"__PKG__": "config", "NAME": "x"}
+	const (
+		src = "package __PKG__ // __PKG__\nvar NAME = \"NAME\" + NAME_2\n"
+		exp = "package config // __PKG__\nvar x = \"NAME\" + NAME_2\n"
+	)
+	nod, err := p.ParseString("symbols", src)
+	if err != nil {
+		z.Fatal(err)
+	}
+	if got := nod.String(); got != exp {
+		z.Errorf("got %q, want %q", got, exp)
+	}
+}
+
+func TestHooks(z *testing.T) {
+	p := New()
+	p.AddCommenter(CppComment, false)
+	p.Hooks = &ast.Hooks{
+		OnText: func(_ *ast.TextNode, s string) string {
+			return strings.ToUpper(s)
+		},
+		OnComment: func(n *ast.CommentNode, _ string) string {
+			return "/*" + n.Body() + " */"
+		},
+		OnFileEnter: func(fn *ast.FileNode) string {
+			return "<" + filepath.Base(fn.Path()) + ">"
+		},
+		OnFileExit: func(fn *ast.FileNode) string {
+			return "</" + filepath.Base(fn.Path()) + ">"
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"root.txt":  "a // b\n#include \"child.txt\"\nc\n",
+		"child.txt": "d\n",
+	}
+	for name, s := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(s), 0644); err != nil {
+			z.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := p.Process(&buf, filepath.Join(dir, "root.txt")); err != nil {
+		z.Fatal(err)
+	}
+	const exp = "<root.txt>A /* b */\n<child.txt>D\n</child.txt>C\n</root.txt>"
+	if got := buf.String(); got != exp {
+		z.Errorf("got %q, want %q", got, exp)
+	}
+}
+
+func TestArchiveInclude(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var zbuf bytes.Buffer
+	zw := zip.NewWriter(&zbuf)
+	w, err := zw.Create("partials/head.html")
+	if err != nil {
+		z.Fatal(err)
+	}
+	io.WriteString(w, "<head>\n")
+	if err := zw.Close(); err != nil {
+		z.Fatal(err)
+	}
+
+	var tbuf bytes.Buffer
+	gz := gzip.NewWriter(&tbuf)
+	tw := tar.NewWriter(gz)
+	const foot = "<foot>\n"
+	tw.WriteHeader(&tar.Header{Name: "./foot.html", Mode: 0644, Size: int64(len(foot)), Typeflag: tar.TypeReg})
+	io.WriteString(tw, foot)
+	if err := tw.Close(); err != nil {
+		z.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		z.Fatal(err)
+	}
+
+	zpath := filepath.Join(dir, "bundle.zip")
+	tpath := filepath.Join(dir, "bundle.tar.gz")
+	if err := ioutil.WriteFile(zpath, zbuf.Bytes(), 0644); err != nil {
+		z.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tpath, tbuf.Bytes(), 0644); err != nil {
+		z.Fatal(err)
+	}
+
+	// Included paths are relative to the directory of the including file.
+	const src = "#include \"bundle.zip!/partials/head.html\"\n" +
+		"#include \"bundle.zip!/foot.html\" or \"bundle.tar.gz!/foot.html\"\n"
+	nod, err := New().ParseString(filepath.Join(dir, "root"), src)
+	if err != nil {
+		z.Fatal(err)
+	}
+	if got, exp := nod.String(), "<head>\n<foot>\n"; got != exp {
+		z.Errorf("got %q, want %q", got, exp)
+	}
+}
+
+// BenchmarkLongLine processes a single line of minified JSON-like text.
+func BenchmarkLongLine(b *testing.B) {
+	line := strings.Repeat(`{"key":"value","list":[1,2,3],"url":"http://example.com/x"},`, 1<<14) + "\n"
+	p := New()
+	p.AddCommenter(&ast.Commenter{Begin: "//"}, false)
+	p.AddCommenter(&ast.Commenter{Begin: "/*", End: "*/"}, false)
+	p.Quotes = `"`
+	b.SetBytes(int64(len(line)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.ParseString("long", line); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPlainText processes a file without any directives or comments.
+func BenchmarkPlainText(b *testing.B) {
+	text := strings.Repeat("The quick brown fox jumps over the lazy dog.\n", 1<<14)
+	p := New()
+	p.AddCommenter(&ast.Commenter{Begin: "//"}, false)
+	p.AddCommenter(&ast.Commenter{Begin: "/*", End: "*/"}, false)
+	b.SetBytes(int64(len(text)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.ParseString("plain", text); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkTabWidth processes a file with a comment on every line, whose
+// columns are counted with tabs.
+func BenchmarkTabWidth(b *testing.B) {
+	text := strings.Repeat("\tcode(); // comment\n", 1<<14)
+	p := New()
+	p.AddCommenter(&ast.Commenter{Begin: "//"}, false)
+	p.TabWidth = 4
+	b.SetBytes(int64(len(text)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.ParseString("tabs", text); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// countingCache counts the entries put into a ResourceCache.
+type countingCache struct {
+	ast.ResourceCache
+	puts int
+}
+
+func (c *countingCache) Put(url, etag string, data []byte) {
+	c.puts++
+	c.ResourceCache.Put(url, etag, data)
+}
+
+func TestResourceCache(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(s string) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		tw.WriteHeader(&tar.Header{Name: "a.txt", Mode: 0644, Size: int64(len(s)), Typeflag: tar.TypeReg})
+		io.WriteString(tw, s)
+		if err := tw.Close(); err != nil {
+			z.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "lib.tar"), buf.Bytes(), 0644); err != nil {
+			z.Fatal(err)
+		}
+	}
+
+	const src = "#include \"lib.tar!/a.txt\"\n#include \"lib.tar!/a.txt\"\n"
+	for _, rc := range []ast.ResourceCache{ast.NewMemoryCache(), ast.DiskCache{Dir: filepath.Join(dir, "cache")}} {
+		write("A\n")
+		c := &countingCache{ResourceCache: rc}
+		p := New()
+		p.ResourceCache = c
+		for _, exp := range []string{"A\nA\n", "A\nA\n"} {
+			nod, err := p.ParseString(filepath.Join(dir, "root"), src)
+			if err != nil {
+				z.Fatal(err)
+			}
+			if s := nod.String(); s != exp {
+				z.Errorf("%T: ParseString() = %q, want %q", rc, s, exp)
+			}
+		}
+		if c.puts != 1 {
+			z.Errorf("%T: %d entries put, want 1", rc, c.puts)
+		}
+
+		// The etag changes with the archive.
+		write("Bee\n")
+		nod, err := p.ParseString(filepath.Join(dir, "root"), src)
+		if err != nil {
+			z.Fatal(err)
+		}
+		if s := nod.String(); s != "Bee\nBee\n" {
+			z.Errorf("%T: ParseString() after change = %q", rc, s)
+		}
+	}
+}
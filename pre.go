@@ -8,34 +8,473 @@
 //
 //  printf
 //  include
+//  include?
 //  require
 //  define
+//  error
+//  message
+//  pragma
+//  process
 //  ifdef
 //  ifndef
 package pre
 
-import "github.com/goulash/pre/ast"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+
+	"github.com/goulash/pre/ast"
+)
+
+// A Dialect determines which preprocessor syntax a Processor understands.
+type Dialect int
+
+const (
+	// DialectPre is the syntax of pre, as configured by the Processor.
+	DialectPre Dialect = iota
+
+	// DialectCPP accepts enough of the syntax of the C preprocessor to
+	// process real C headers for analysis. Files included as #include <file>
+	// are searched for in IncludePaths, directives can be continued on the
+	// next line with a backslash, and Builtins such as __FILE__ are replaced.
+	// Conditionals, #pragma, and all other directives pre does not know are
+	// output verbatim, as with KeepDirectives; they are not evaluated. If no
+	// Commenters or Quotes are configured, those of C are used.
+	DialectCPP
+)
 
 type Processor struct {
+	// Dialect is the preprocessor syntax that is understood.
+	// The default is DialectPre.
+	Dialect Dialect
+
 	// Trigger is the string which begins an action (command).
 	// The default trigger is "#", which is the same as the C/C++ pre-processor.
 	Trigger string
 
+	// KeepDirectives lets pre run in front of another preprocessor, such as
+	// the C preprocessor. Instead of failing on directives with commands that
+	// pre does not know, such as #pragma or #ifdef, they are output verbatim.
+	// This also applies to includes of the form #include <stdio.h>, and to
+	// define directives, since pre does not expand macros.
+	KeepDirectives bool
+
+	// IncludePaths are the directories in which files included with the
+	// syntax #include <file> are searched for, in order. Without them, this
+	// syntax is only understood in DialectCPP, which keeps it verbatim.
+	IncludePaths []string
+
+	// IncludeMap binds logical names that files include, such as
+	// "stdlib/strings", to the paths of actual files, so that the build
+	// environment can decide which files these are. A key that ends in a
+	// slash binds all names that begin with it to a directory:
+	//
+	//  {"stdlib/": "/usr/share/tmpl/std", "config": "conf/prod.conf"}
+	//
+	// Relative paths are relative to the current directory. See also
+	// LoadIncludeMap.
+	IncludeMap map[string]string
+
+	// Fragments are named snippets that are included like files, with the
+	// name in angle brackets, so that applications can ship them inside of
+	// the binary. See RegisterFragment.
+	Fragments map[string]string
+
+	// IncludeDirs makes including a directory include all files in it in
+	// sorted order, instead of failing with ast.ErrIsDir. Files that are
+	// added to the directory later do not invalidate the CacheDir.
+	IncludeDirs bool
+
+	// IgnoreCase makes command names case-insensitive, so that #INCLUDE
+	// and #Include are the same as #include.
+	IgnoreCase bool
+
+	// Aliases maps alternative command names to the command they stand for,
+	// such as "import" to "include". This allows pre to understand the
+	// dialect of another preprocessor. If IgnoreCase is true, the keys of
+	// Aliases must be in lower case.
+	Aliases map[string]string
+
+	// EscapeTrigger allows a line to begin with a literal trigger, by writing
+	// the trigger twice. With the default trigger, the line
+	//
+	//  ##include "file"
+	//
+	// is then output as the text #include "file" instead of being executed.
+	EscapeTrigger bool
+
 	// MaxIncludeDepth is the maximum number of nested includes that can occur
 	// before an error is thrown. This is to prevent infinite include loops.
 	MaxIncludeDepth int
 
+	// MaxSteps limits the work that a single parse may do, so that
+	// pathological input fails quickly with ast.ErrBudgetExceeded instead
+	// of tying up resources. Roughly one step is taken per token, including
+	// those of included files. There is no limit if MaxSteps is zero.
+	MaxSteps int
+
+	// MaxOutputSize and MaxExpansion cap the size of the output, so that
+	// input which expands exponentially, such as files that include each
+	// other repeatedly, fails with ast.ErrOutputExceeded instead of
+	// exhausting memory. MaxOutputSize is in bytes, while MaxExpansion is
+	// the factor by which the output may be larger than the input, which
+	// is all distinct files read. There is no limit if they are zero.
+	MaxOutputSize int
+	MaxExpansion  int
+
+	// MaxTokenSize bounds the size of the nodes of the tree. Text is split
+	// into nodes of at most MaxTokenSize bytes, while comments longer than
+	// that are an error, since a comment cannot be split. There is no limit
+	// if MaxTokenSize is zero.
+	MaxTokenSize int
+
+	// Builtins replaces __FILE__ and __LINE__ in the text by the quoted name
+	// of the file and the line, and __BASENAME__ and __EXT__ by the name of
+	// the root file and its extension, such as main.go and go. Builtins are
+	// only replaced outside of comments and string literals, as entire
+	// identifiers. They are always replaced in DialectCPP.
+	Builtins bool
+
+	// PlatformBuiltins replaces __GOOS__ and __GOARCH__ in the text by the
+	// operating system and architecture that pre runs on, such as linux and
+	// amd64, and __HOSTNAME__ and __USER__ by the names of the host and of
+	// the user, so that build scripts need not define them. Since the output
+	// then depends on the machine, it is not cached in CacheDir, and they are
+	// not replaced in SafeMode.
+	PlatformBuiltins bool
+
+	// Deterministic makes the output depend only on the files and on the
+	// settings of the processor, so that the same inputs always produce the
+	// same output, as for hermetic builds. PlatformBuiltins are then not
+	// replaced, and Defines whose Source is ast.SourceEnvironment are left
+	// out, unless their names are in AllowEnv.
+	Deterministic bool
+
+	// AllowEnv are the names of the Defines from the environment that are
+	// still defined if Deterministic is true.
+	AllowEnv []string
+
+	// TabWidth makes positions in error messages and nodes report the column
+	// that an editor shows, instead of the byte offset in the line. Each
+	// character takes one column, and tabs advance to the next multiple of
+	// TabWidth. Byte columns are reported if TabWidth is zero.
+	TabWidth int
+
+	// Symbols are replaced by their values wherever their names occur in
+	// the text, outside of comments and string literals, as entire
+	// identifiers. For example, with the symbol __VERSION__, the text
+	// __VERSION__ is replaced, but __VERSION__2 is not.
+	Symbols map[string]string
+
+	// Defines are macros that are defined before a file is parsed,
+	// as if by the define command. See Define.
+	Defines []ast.Macro
+
+	// Redefine decides what happens when a macro is defined again with a
+	// different value: the last or first definition wins, a diagnostic is
+	// reported, or an error is returned. The default is ast.RedefineLast.
+	Redefine ast.Redefinition
+
+	// NameBase and SlashNames make the names of files in error messages and
+	// positions stable across machines. If NameBase is not empty, names are
+	// relative to the directory NameBase where possible, and if SlashNames
+	// is true, they use forward slashes on all systems.
+	NameBase   string
+	SlashNames bool
+
 	// Commenters define what kind of comments are accepted in the parsed text.
 	// Triggers are ignored when they are inside a comment. Comments can also
 	// be stripped out of the text, or just left there.
 	Commenters ast.Commenters
+
+	// Quotes are the characters that delimit string literals in the text,
+	// such as "\"'" for C. Comment markers inside a string literal, such as
+	// the // in "http://", are then not treated as comments. A string literal
+	// ends at its closing quote or at the end of the line, and a backslash
+	// escapes the character following it.
+	Quotes string
+
+	// Quoting decides how strings in directives, such as the paths of
+	// include, are quoted and escaped, such as ast.RawQuoting for Windows
+	// paths and regular expressions. If it is nil, ast.DefaultQuoting is
+	// used. Since an Unescape function is code, the output is not cached in
+	// CacheDir if there is one.
+	Quoting *ast.Quoting
+
+	// RequireByContent makes require deduplicate files by the hash of their
+	// content instead of by their resolved path. This catches the same file
+	// being reachable under different paths, such as different mount points.
+	RequireByContent bool
+
+	// RequireCache shares the trees of required files between the parses
+	// of this Processor, so that a prelude that many files require is only
+	// parsed once. Use ast.NewRequireCache to create it. The settings of
+	// the Processor must not change while it is used.
+	RequireCache *ast.RequireCache `json:"-"`
+
+	// Stats collect the time spent reading and parsing each file over all
+	// parses of this Processor, such as with ast.NewStats, which shows where
+	// the time goes in large include trees. Files whose output is taken
+	// from CacheDir are not parsed, and thus not timed.
+	Stats *ast.Stats `json:"-"`
+
+	// Fates makes the parser record what becomes of each part of the
+	// source, so that ast.FileNode.Fate can tell whether a position was
+	// emitted, stripped, replaced, or removed. It costs memory for every
+	// token, so it is off by default.
+	Fates bool
+
+	// Metrics count how many times each command is run in each file over
+	// all parses of this Processor, such as with ast.NewMetrics, so that it
+	// can be seen which commands are relied upon. Like Commands, they are
+	// not counted again when the output is taken from CacheDir.
+	Metrics *ast.Metrics `json:"-"`
+
+	// ResourceCache stores the files that are read from archives, such as
+	// ast.NewMemoryCache for a single run, or ast.DiskCache to extract each
+	// file only once over many runs.
+	ResourceCache ast.ResourceCache `json:"-"`
+
+	// HeaderLines enables the removal of a header, such as a license, from
+	// the processed file. The header is the block of comments at the very
+	// beginning of the file, starting within the first HeaderLines lines.
+	// It is replaced by Header, which may be empty. Headers of included
+	// files are not affected.
+	HeaderLines int
+	Header      string
+
+	// FoldCase makes require compare the paths of files case-insensitively,
+	// so that a file is not read twice if it is included under names that
+	// differ in case. New enables it on Windows and macOS, whose file
+	// systems are case-insensitive by default.
+	FoldCase bool
+
+	// Diagnostics receives conditions that do not stop processing, but may
+	// be of interest, such as paths that could not be resolved or macros
+	// that were redefined. Use ast.WriterSink to print them. They are
+	// discarded if Diagnostics is nil.
+	Diagnostics ast.DiagnosticsSink
+
+	// Messages is called with the text of each message command, such as
+	//
+	//  #message "generating tables"
+	//
+	// which is meant for notes on the progress of long pipelines. Messages
+	// do not affect the output. If Messages is nil, they are passed to
+	// Diagnostics with the code "message" instead. Like diagnostics, they
+	// are not reported again when the output is taken from CacheDir.
+	Messages func(pi ast.PosInfo, msg string) `json:"-"`
+
+	// Commands is called with each command that is run, such as include or
+	// define, and its typed arguments, so that tools can audit files without
+	// lexing directives themselves. Like Messages, it is not called again
+	// when the output is taken from CacheDir.
+	Commands func(c ast.Command) `json:"-"`
+
+	// FS is the file system that files are read from, instead of that of
+	// the operating system. With an ast.MapFS, for example, pre can run in
+	// a browser, built with GOOS=js and GOARCH=wasm. Process does not use
+	// CacheDir if FS is set.
+	FS ast.FileSystem `json:"-"`
+
+	// Mmap makes Process map files into memory instead of reading them,
+	// where the system supports it, which keeps the memory use of the
+	// process low when processing many large files. The strings passed to
+	// Hooks must then not be retained after Process returns. Mmap does not
+	// affect Parse and ParseString.
+	Mmap bool
+
+	// Symlinks decides how symbolic links in the paths of included files
+	// are treated: they can be evaluated, kept as they are, or evaluated
+	// with links out of the directory of the root file being an error.
+	// The default is ast.SymlinksFollow.
+	Symlinks ast.SymlinkPolicy
+
+	// SafeMode restricts processing to pure text transformation, for when
+	// the input cannot be trusted. All commands that would access the file
+	// system, such as include and require, fail with ast.ErrSafeMode.
+	// The file passed to Parse or Process is still read, of course.
+	SafeMode bool
+
+	// Patterns are the file name patterns, as understood by filepath.Match,
+	// of files that are processed by ProcessDir. All other files are copied.
+	Patterns []string
+
+	// Rename maps the names of processed files to the names of their output
+	// in ProcessDir. The first rule whose From suffix matches is applied.
+	Rename []Rename
+
+	// Routes select a different Processor for the files in ProcessDir and
+	// CheckDir whose name matches the Pattern of a route, such as to use
+	// other triggers and commenters for shell scripts than for C files.
+	// The first matching route is used, and files that match a route are
+	// processed even if they match none of the Patterns. Rename always
+	// comes from the Processor on which ProcessDir is called.
+	Routes []Route `json:"-"`
+
+	// Hooks transform the output of the nodes as it is rendered by Process,
+	// such as to trim trailing whitespace or to add a banner to each file.
+	// Since the output then depends on code, it is not cached in CacheDir.
+	Hooks *ast.Hooks
+
+	// Binary decides what happens to included files that contain NUL bytes:
+	// by default this is an error, ast.ErrBinary, but with
+	// ast.BinaryPassthrough they are output untouched. Transformers are
+	// applied before this check, so they can convert binary files.
+	Binary ast.BinaryPolicy
+
+	// StrictUTF8 makes files that are not valid UTF-8 an error, which is
+	// ast.ErrInvalidUTF8 with the position of the first invalid byte.
+	// Otherwise such files, such as those in Latin-1, are parsed as usual.
+	StrictUTF8 bool
+
+	// Transformers convert the content of included files before it is
+	// parsed, such as from CSV to a Markdown table. They are referred to by
+	// name in the include command:
+	//
+	//  #include "data.csv" via csv2md
+	//
+	// Since the output then depends on code, it is not cached in CacheDir.
+	Transformers map[string]Filter
+
+	// Filters are applied to the output of Process in order, after it is
+	// rendered and before it is written. For example, format.Source from
+	// the package go/format can be used as a filter to format Go code.
+	Filters []Filter
+
+	// Banner is a comment that Process puts at the beginning of the output,
+	// after a shebang line such as #!/bin/sh, which must remain the first.
+	// It is written with the first of the Commenters, such as DefaultBanner:
+	//
+	//  // generated by pre from config.go.pre (sha256 9f86d0...); do not edit
+	//
+	// In Banner, {source} is replaced by the name of the processed file as
+	// in positions, see NameBase and SlashNames, and {sha256} by the hash of
+	// its content. Nothing is added if it is empty.
+	Banner string
+
+	// FinalNewline makes Process end the output with a newline, if it is
+	// not empty and does not already end with one.
+	FinalNewline bool
+
+	// CacheDir is the directory in which Process caches its output. The
+	// output of a file is reused as long as neither the file, nor the files
+	// it includes, nor the settings of the Processor change. An optional
+	// include of a file that did not exist is not tracked, however, so
+	// creating such a file does not invalidate the cache. Nothing is cached
+	// if CacheDir is empty.
+	CacheDir string
+
+	// BackupSuffix is appended to the path of a file to create a backup of
+	// it before ProcessInPlace overwrites it. No backup is made if empty.
+	BackupSuffix string
+
+	keepPragmas bool // outputs pragmas verbatim, for Flatten
+}
+
+// A Filter transforms the entire output of a file.
+type Filter func([]byte) ([]byte, error)
+
+// Rename replaces the suffix From of a file name with To, for example
+// {".c.pre", ".c"} maps main.c.pre to main.c, and {".in", ""} strips .in.
+type Rename struct {
+	From string
+	To   string
+}
+
+// A Route uses Processor for the files whose name matches Pattern, as
+// understood by filepath.Match.
+type Route struct {
+	Pattern   string
+	Processor *Processor
 }
 
-func New() *Processor {
-	return &Processor{
+// New returns a Processor with the trigger # and a maximum include depth
+// of 128, to which the options opts are then applied.
+func New(opts ...Option) *Processor {
+	p := &Processor{
 		Trigger:         "#",
 		MaxIncludeDepth: 128,
+		FoldCase:        runtime.GOOS == "windows" || runtime.GOOS == "darwin",
 	}
+	p.Apply(opts...)
+	return p
+}
+
+// Clone returns a copy of p that can be changed without affecting p, so
+// that a base configuration can be set up once and then cloned for every
+// request, which then adds its own defines and settings. The slices and
+// maps of p are copied, as are its Commenters, Hooks, and Quoting. The
+// RequireCache, the ResourceCache, the Stats, the Metrics, the Diagnostics,
+// the FS, and the Processors of the Routes are shared, since they are
+// meant to be used by several processors at once and collect results over
+// all of them.
+func (p *Processor) Clone() *Processor {
+	q := *p
+	q.IncludePaths = copyStrings(p.IncludePaths)
+	q.IncludeMap = copyMap(p.IncludeMap)
+	q.Fragments = copyMap(p.Fragments)
+	q.Aliases = copyMap(p.Aliases)
+	q.Symbols = copyMap(p.Symbols)
+	q.Patterns = copyStrings(p.Patterns)
+	q.AllowEnv = copyStrings(p.AllowEnv)
+	if p.Defines != nil {
+		q.Defines = append([]ast.Macro(nil), p.Defines...)
+	}
+	if p.Commenters != nil {
+		q.Commenters = make(ast.Commenters, len(p.Commenters))
+		for i, c := range p.Commenters {
+			c := *c
+			q.Commenters[i] = &c
+		}
+	}
+	if p.Rename != nil {
+		q.Rename = append([]Rename(nil), p.Rename...)
+	}
+	if p.Routes != nil {
+		q.Routes = append([]Route(nil), p.Routes...)
+	}
+	if p.Hooks != nil {
+		h := *p.Hooks
+		q.Hooks = &h
+	}
+	if p.Quoting != nil {
+		qu := *p.Quoting
+		q.Quoting = &qu
+	}
+	if p.Transformers != nil {
+		q.Transformers = make(map[string]Filter, len(p.Transformers))
+		for name, f := range p.Transformers {
+			q.Transformers[name] = f
+		}
+	}
+	if p.Filters != nil {
+		q.Filters = append([]Filter(nil), p.Filters...)
+	}
+	return &q
+}
+
+func copyStrings(ss []string) []string {
+	if ss == nil {
+		return nil
+	}
+	return append([]string(nil), ss...)
+}
+
+func copyMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
 }
 
 func (p *Processor) AddCommenter(c *ast.Commenter, strip bool) {
@@ -43,24 +482,348 @@ func (p *Processor) AddCommenter(c *ast.Commenter, strip bool) {
 	p.Commenters = append(p.Commenters, c)
 }
 
-func (p *Processor) Parse(path string) (ast.Node, error) {
+// RegisterFragment adds a fragment with the given name and content, which
+// can then be included without touching the file system:
+//
+//  #include "<prelude>"
+//
+// A fragment of the same name is replaced.
+func (p *Processor) RegisterFragment(name, content string) {
+	if p.Fragments == nil {
+		p.Fragments = make(map[string]string)
+	}
+	p.Fragments[name] = content
+}
+
+// LoadIncludeMap adds the bindings of the JSON object in the file at path to
+// IncludeMap, replacing those of the same names. Relative paths in the file
+// are relative to the directory of the file.
+func (p *Processor) LoadIncludeMap(path string) error {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var m map[string]string
+	if err := json.Unmarshal(bs, &m); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if p.IncludeMap == nil {
+		p.IncludeMap = make(map[string]string, len(m))
+	}
+	dir := filepath.Dir(path)
+	for name, target := range m {
+		target = filepath.FromSlash(target)
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(dir, target)
+		}
+		p.IncludeMap[name] = target
+	}
+	return nil
+}
+
+// Define adds the macro name with the given value to Defines.
+func (p *Processor) Define(name, value string) {
+	p.Defines = append(p.Defines, ast.Macro{Name: name, Value: value, Source: ast.SourceAPI})
+}
+
+// A ParseOption changes the settings of a Processor for a single call of
+// Parse, ParseString, or Process, without changing the Processor, so that
+// it can be used for different variants of the same file concurrently.
+type ParseOption func(*Processor)
+
+// KeepComments keeps all comments, regardless of whether their Commenter
+// strips them.
+func KeepComments() ParseOption { return stripComments(false) }
+
+// StripComments strips all comments, regardless of whether their Commenter
+// keeps them.
+func StripComments() ParseOption { return stripComments(true) }
+
+func stripComments(strip bool) ParseOption {
+	return func(p *Processor) {
+		for i, c := range p.Commenters {
+			cc := *c
+			cc.Strip = strip
+			p.Commenters[i] = &cc
+		}
+	}
+}
+
+// with returns p if opts is empty, and otherwise a clone of p to which the
+// options are applied.
+func (p *Processor) with(opts []ParseOption) *Processor {
+	if len(opts) == 0 {
+		return p
+	}
+	q := p.Clone()
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q
+}
+
+// Parse parses the file at path and returns its tree, with the options
+// opts applied for this call only.
+func (p *Processor) Parse(path string, opts ...ParseOption) (ast.Node, error) {
+	p = p.with(opts)
 	parser := newParser(p)
 	err := parser.Parse(path)
 	nod := parser.Root()
 	return nod, err
 }
 
-func (p *Processor) ParseString(name, code string) (ast.Node, error) {
+// ParseString is the same as Parse, except that the code of the file is
+// given, with name as its name.
+func (p *Processor) ParseString(name, code string, opts ...ParseOption) (ast.Node, error) {
+	p = p.with(opts)
 	parser := newParser(p)
 	err := parser.ParseString(name, code)
 	nod := parser.Root()
 	return nod, err
 }
 
+// Index parses each of the files in paths and returns an index of where
+// all the files that they include are included from.
+func (p *Processor) Index(paths ...string) (*ast.Index, error) {
+	x := ast.NewIndex()
+	for _, path := range paths {
+		parser := newParser(p)
+		parser.Index = x
+		if err := parser.Parse(path); err != nil {
+			return nil, err
+		}
+	}
+	return x, nil
+}
+
+// IncludeGraph parses each of the files in paths and returns the graph of
+// all files that they include and require.
+func (p *Processor) IncludeGraph(paths ...string) (*ast.Graph, error) {
+	g := ast.NewGraph()
+	for _, path := range paths {
+		parser := newParser(p)
+		parser.Graph = g
+		if err := parser.Parse(path); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// Process parses the file at path and writes the result to w.
+// The result is passed through the Filters first, if there are any.
+// The options opts are applied for this call only.
+func (p *Processor) Process(w io.Writer, path string, opts ...ParseOption) error {
+	p = p.with(opts)
+	if !p.FinalNewline {
+		return p.filter(w, path)
+	}
+	lw := &lastWriter{w: w}
+	if err := p.filter(lw, path); err != nil {
+		return err
+	}
+	if lw.n > 0 && lw.last != '\n' {
+		_, err := io.WriteString(w, "\n")
+		return err
+	}
+	return nil
+}
+
+// lastWriter remembers the last byte written to w.
+type lastWriter struct {
+	w    io.Writer
+	n    int64
+	last byte
+}
+
+func (lw *lastWriter) Write(bs []byte) (int, error) {
+	n, err := lw.w.Write(bs)
+	if n > 0 {
+		lw.n += int64(n)
+		lw.last = bs[n-1]
+	}
+	return n, err
+}
+
+// filter renders the file at path and passes it through the Filters.
+func (p *Processor) filter(w io.Writer, path string) error {
+	if len(p.Filters) == 0 {
+		return p.render(w, path)
+	}
+
+	var buf bytes.Buffer
+	if err := p.render(&buf, path); err != nil {
+		return err
+	}
+	bs := buf.Bytes()
+	for _, f := range p.Filters {
+		var err error
+		if bs, err = f(bs); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(bs)
+	return err
+}
+
+// render parses the file at path and writes the unfiltered result to w,
+// beginning with the Banner, which follows a shebang line if there is one.
+func (p *Processor) render(w io.Writer, path string) error {
+	if p.Banner == "" {
+		return p.renderTree(w, path)
+	}
+	var buf bytes.Buffer
+	if err := p.renderTree(&buf, path); err != nil {
+		return err
+	}
+	bs := buf.Bytes()
+	n := 0
+	if bytes.HasPrefix(bs, []byte("#!")) {
+		if n = bytes.IndexByte(bs, '\n') + 1; n == 0 {
+			n = len(bs)
+		}
+	}
+	if _, err := w.Write(bs[:n]); err != nil {
+		return err
+	}
+	if n > 0 && bs[n-1] != '\n' {
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+	}
+	if err := p.writeBanner(w, path); err != nil {
+		return err
+	}
+	_, err := w.Write(bs[n:])
+	return err
+}
+
+// renderTree parses the file at path and writes the tree to w.
+func (p *Processor) renderTree(w io.Writer, path string) error {
+	if p.CacheDir != "" && p.cacheable() {
+		return p.processCached(w, path)
+	}
+	parser := newParser(p)
+	parser.Mmap = p.Mmap
+	defer parser.Close()
+	if err := parser.Parse(path); err != nil {
+		return err
+	}
+	_, err := parser.Root().Render(w, p.Hooks)
+	return err
+}
+
+// cacheable returns true if the output of p only depends on its settings
+// and on files, and not on code, such as Hooks, on the FS, or on the
+// machine, as with PlatformBuiltins.
+func (p *Processor) cacheable() bool {
+	if p.Quoting != nil && p.Quoting.Unescape != nil {
+		return false
+	}
+	platform := p.PlatformBuiltins && !p.Deterministic
+	return p.Hooks == nil && len(p.Transformers) == 0 && p.FS == nil && !platform
+}
+
+// defines returns the Defines, without those from the environment that
+// Deterministic leaves out.
+func (p *Processor) defines() []ast.Macro {
+	if !p.Deterministic {
+		return p.Defines
+	}
+	allow := make(map[string]bool, len(p.AllowEnv))
+	for _, name := range p.AllowEnv {
+		allow[name] = true
+	}
+	var ms []ast.Macro
+	for _, m := range p.Defines {
+		if m.Source != ast.SourceEnvironment || allow[m.Name] {
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
+
+// transformers converts the Transformers of a Processor for the parser.
+func transformers(m map[string]Filter) map[string]func([]byte) ([]byte, error) {
+	if m == nil {
+		return nil
+	}
+	ts := make(map[string]func([]byte) ([]byte, error), len(m))
+	for name, f := range m {
+		ts[name] = f
+	}
+	return ts
+}
+
 func newParser(p *Processor) *ast.Parser {
-	return &ast.Parser{
-		Trigger:         p.Trigger,
-		MaxIncludeDepth: p.MaxIncludeDepth,
-		Commenters:      p.Commenters,
+	parser := &ast.Parser{
+		Trigger:          p.Trigger,
+		KeepDirectives:   p.KeepDirectives,
+		KeepPragmas:      p.keepPragmas,
+		IgnoreCase:       p.IgnoreCase,
+		IncludeMap:       p.IncludeMap,
+		Fragments:        p.Fragments,
+		IncludeDirs:      p.IncludeDirs,
+		Aliases:          p.Aliases,
+		EscapeTrigger:    p.EscapeTrigger,
+		MaxIncludeDepth:  p.MaxIncludeDepth,
+		MaxSteps:         p.MaxSteps,
+		MaxTokenSize:     p.MaxTokenSize,
+		MaxOutputSize:    p.MaxOutputSize,
+		MaxExpansion:     p.MaxExpansion,
+		Commenters:       p.Commenters,
+		Quotes:           p.Quotes,
+		Quoting:          p.Quoting,
+		TabWidth:         p.TabWidth,
+		Builtins:         p.Builtins,
+		PlatformBuiltins: p.PlatformBuiltins && !p.Deterministic,
+		RequireByContent: p.RequireByContent,
+		RequireCache:     p.RequireCache,
+		Stats:            p.Stats,
+		Metrics:          p.Metrics,
+		Fates:            p.Fates,
+		ResourceCache:    p.ResourceCache,
+		FoldCase:         p.FoldCase,
+		Symlinks:         p.Symlinks,
+		Sink:             p.Diagnostics,
+		OnMessage:        p.Messages,
+		OnCommand:        p.Commands,
+		NameBase:         p.NameBase,
+		SlashNames:       p.SlashNames,
+		SafeMode:         p.SafeMode,
+		HeaderLines:      p.HeaderLines,
+		Header:           p.Header,
+		Symbols:          p.Symbols,
+		Transformers:     transformers(p.Transformers),
+		StrictUTF8:       p.StrictUTF8,
+		Binary:           p.Binary,
+		FS:               p.FS,
+		Defines:          p.defines(),
+		Redefine:         p.Redefine,
+		IncludePaths:     p.IncludePaths,
+	}
+	if p.Dialect == DialectCPP {
+		parser.KeepDirectives = true
+		parser.LineContinuation = true
+		parser.Builtins = true
+		if len(parser.Commenters) == 0 {
+			parser.Commenters = ast.Commenters{
+				{Begin: "//"},
+				{Begin: "/*", End: "*/"},
+			}
+		}
+		if parser.Quotes == "" {
+			parser.Quotes = `"'`
+		}
+	}
+	return parser
+}
+
+// readFile returns the content of the file at path, which is read from the
+// FS if it is set, and may be in an archive otherwise.
+func (p *Processor) readFile(path string) ([]byte, error) {
+	if p.FS != nil {
+		return p.FS.ReadFile(path)
 	}
+	return ast.ReadFile(path)
 }
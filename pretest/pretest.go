@@ -0,0 +1,154 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+// Package pretest helps to test templates processed by pre with golden
+// files: each file with the extension .test is processed and compared to
+// the file of the same name with the extension .result. For example:
+//
+//  func TestTemplates(t *testing.T) {
+//  	p := pre.New()
+//  	p.AddCommenter(pre.CComment, true)
+//  	pretest.Golden(t, p, "testdata/*.test")
+//  }
+//
+// Running go test with the flag -update writes the output of the processor
+// to the result files instead of comparing it.
+package pretest
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/goulash/pre"
+)
+
+// Extensions of test files and of the golden files with their results.
+const (
+	TestExt   = ".test"
+	ResultExt = ".result"
+)
+
+// Update makes Golden and Check write the result files instead of comparing
+// them. It is set with the flag -update.
+var Update = flag.Bool("update", false, "update the result files of pretest")
+
+// Golden calls Check for each test file that matches pattern, which is
+// understood by filepath.Glob. It is an error if no file matches.
+func Golden(t testing.TB, p *pre.Processor, pattern string) {
+	t.Helper()
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) == 0 {
+		t.Fatalf("no test files match %s", pattern)
+	}
+	for _, m := range matches {
+		Check(t, p, m, ResultPath(m))
+	}
+}
+
+// Check processes the file at path with p and compares the output to the
+// content of the file at result, reporting the difference as an error.
+// If Update is set, the output is written to result instead.
+func Check(t testing.TB, p *pre.Processor, path, result string) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := p.Process(&buf, path); err != nil {
+		t.Errorf("%s: %v", path, err)
+		return
+	}
+	if *Update {
+		if err := ioutil.WriteFile(result, buf.Bytes(), 0644); err != nil {
+			t.Error(err)
+		}
+		return
+	}
+
+	exp, err := ioutil.ReadFile(result)
+	if os.IsNotExist(err) {
+		t.Errorf("missing result file: %s (run go test -update to create it)", result)
+		return
+	} else if err != nil {
+		t.Error(err)
+		return
+	}
+	if d := Diff(string(exp), buf.String()); d != "" {
+		t.Errorf("%s: output differs from %s:\n%s", path, result, d)
+	}
+}
+
+// ResultPath returns the path of the result file for the test file at path,
+// replacing TestExt by ResultExt, or appending ResultExt if path does not
+// end in TestExt.
+func ResultPath(path string) string {
+	return strings.TrimSuffix(path, TestExt) + ResultExt
+}
+
+// Diff returns the difference between the lines of exp and got, in the
+// style of a unified diff without context: lines only in exp are prefixed
+// with "-", lines only in got with "+", and common lines with " ". Diff
+// returns the empty string if exp and got are equal.
+func Diff(exp, got string) string {
+	if exp == got {
+		return ""
+	}
+	a, b := strings.SplitAfter(exp, "\n"), strings.SplitAfter(got, "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence
+	// of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	line := func(prefix, s string) {
+		if s == "" {
+			return
+		}
+		if !strings.HasSuffix(s, "\n") {
+			s += "\n\\ No newline at end of file\n"
+		}
+		fmt.Fprintf(&buf, "%s%s", prefix, s)
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			line(" ", a[i])
+			i, j = i+1, j+1
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			line("-", a[i])
+			i++
+		default:
+			line("+", b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		line("-", a[i])
+	}
+	for ; j < len(b); j++ {
+		line("+", b[j])
+	}
+	return buf.String()
+}
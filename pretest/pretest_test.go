@@ -0,0 +1,34 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package pretest
+
+import (
+	"testing"
+
+	"github.com/goulash/pre"
+)
+
+func TestGolden(z *testing.T) {
+	p := pre.New()
+	p.AddCommenter(pre.CppComment, true)
+	Golden(z, p, "testdata/*.test")
+}
+
+func TestDiff(z *testing.T) {
+	var tests = []struct {
+		Exp, Got string
+		Diff     string
+	}{
+		{"a\nb\n", "a\nb\n", ""},
+		{"a\nb\nc\n", "a\nc\n", " a\n-b\n c\n"},
+		{"a\n", "a\nb\n", " a\n+b\n"},
+		{"a\n", "a", "-a\n+a\n\\ No newline at end of file\n"},
+	}
+	for _, t := range tests {
+		if d := Diff(t.Exp, t.Got); d != t.Diff {
+			z.Errorf("Diff(%q, %q) = %q, want %q", t.Exp, t.Got, d, t.Diff)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package pre
+
+import (
+	"encoding/json"
+	"io"
+	"path/filepath"
+
+	"github.com/goulash/pre/ast"
+)
+
+// A Report collects errors and diagnostics, so that they can be written
+// in a machine-readable format for CI systems and code review tools.
+// A Report is a DiagnosticsSink, and is typically used as
+//
+//  r := &pre.Report{}
+//  p.Diagnostics = r
+//  r.AddError(p.Process(w, path))
+//  r.WriteSARIF(os.Stdout)
+//
+type Report struct {
+	Findings []Finding
+}
+
+// A Finding is a single error or diagnostic in a Report.
+type Finding struct {
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"` // error or warning
+	Code     string `json:"code,omitempty"`
+	Message  string `json:"message"`
+}
+
+// Diagnose adds the diagnostic d to the report as a warning.
+func (r *Report) Diagnose(d ast.Diagnostic) {
+	r.Findings = append(r.Findings, Finding{
+		File:     d.Name,
+		Line:     d.Line,
+		Column:   d.Column,
+		Severity: "warning",
+		Code:     d.Code,
+		Message:  d.Message,
+	})
+}
+
+// AddError adds err to the report, if it is not nil.
+func (r *Report) AddError(err error) {
+	if err == nil {
+		return
+	}
+	f := Finding{Severity: "error", Message: err.Error()}
+	if e, ok := err.(*ast.Error); ok {
+		f.File, f.Line, f.Column = e.PosInfo.Name, e.PosInfo.Line, e.PosInfo.Column
+		f.Code = errorCode(e.Err)
+		f.Message = errorMessage(e)
+	}
+	r.Findings = append(r.Findings, f)
+}
+
+// errorMessage returns the message of e without its position, but with
+// the chain of includes that led to it.
+func errorMessage(e *ast.Error) string {
+	msg := e.Err.Error()
+	for i, pi := range e.Includes {
+		if i == 0 {
+			msg += ", included from " + pi.String()
+		} else {
+			msg += ", from " + pi.String()
+		}
+	}
+	return msg
+}
+
+// errorCode returns the code of the errors that pre defines.
+func errorCode(err error) string {
+	switch err {
+	case ast.ErrMaxDepthExceeded:
+		return "max-depth-exceeded"
+	case ast.ErrSafeMode:
+		return "safe-mode"
+	case ast.ErrBudgetExceeded:
+		return "budget-exceeded"
+	}
+	if e, ok := err.(interface{ Unwrap() error }); ok && e.Unwrap() == ast.ErrSymlinkEscape {
+		return "symlink-escape"
+	}
+	return ""
+}
+
+// WriteJSON writes the findings to w as a JSON array.
+func (r *Report) WriteJSON(w io.Writer) error {
+	fs := r.Findings
+	if fs == nil {
+		fs = []Finding{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(fs)
+}
+
+// WriteSARIF writes the findings to w as a SARIF 2.1.0 log.
+func (r *Report) WriteSARIF(w io.Writer) error {
+	type region struct {
+		StartLine   int `json:"startLine"`
+		StartColumn int `json:"startColumn,omitempty"`
+	}
+	type location struct {
+		PhysicalLocation struct {
+			ArtifactLocation struct {
+				URI string `json:"uri"`
+			} `json:"artifactLocation"`
+			Region *region `json:"region,omitempty"`
+		} `json:"physicalLocation"`
+	}
+	type message struct {
+		Text string `json:"text"`
+	}
+	type result struct {
+		RuleID    string     `json:"ruleId,omitempty"`
+		Level     string     `json:"level"`
+		Message   message    `json:"message"`
+		Locations []location `json:"locations,omitempty"`
+	}
+	type driver struct {
+		Name           string `json:"name"`
+		InformationURI string `json:"informationUri"`
+	}
+	type run struct {
+		Tool struct {
+			Driver driver `json:"driver"`
+		} `json:"tool"`
+		Results []result `json:"results"`
+	}
+	type log struct {
+		Version string `json:"version"`
+		Schema  string `json:"$schema"`
+		Runs    []run  `json:"runs"`
+	}
+
+	var rn run
+	rn.Tool.Driver = driver{"pre", "https://github.com/goulash/pre"}
+	rn.Results = []result{}
+	for _, f := range r.Findings {
+		res := result{RuleID: f.Code, Level: f.Severity, Message: message{f.Message}}
+		if f.File != "" {
+			var loc location
+			loc.PhysicalLocation.ArtifactLocation.URI = filepath.ToSlash(f.File)
+			if f.Line > 0 {
+				loc.PhysicalLocation.Region = &region{f.Line, f.Column}
+			}
+			res.Locations = []location{loc}
+		}
+		rn.Results = append(rn.Results, res)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(log{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []run{rn},
+	})
+}
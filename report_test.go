@@ -0,0 +1,60 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package pre
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/goulash/pre/ast"
+)
+
+func TestReport(z *testing.T) {
+	r := &Report{}
+	p := New()
+	p.Redefine = ast.RedefineWarn
+	p.Diagnostics = r
+	_, err := p.ParseString("internal", "#define A 1\n#define A 2\n#foo\n")
+	r.AddError(err)
+
+	if len(r.Findings) != 2 {
+		z.Fatalf("Findings = %v, want 2 findings", r.Findings)
+	}
+	if f := r.Findings[0]; f.Severity != "warning" || f.Code != "redefined-macro" || f.Line != 2 {
+		z.Errorf("Findings[0] = %+v, want redefined-macro warning at line 2", f)
+	}
+	if f := r.Findings[1]; f.Severity != "error" || f.File != "internal" || f.Line != 3 {
+		z.Errorf("Findings[1] = %+v, want error at line 3", f)
+	}
+
+	var buf bytes.Buffer
+	if err := r.WriteJSON(&buf); err != nil {
+		z.Fatal(err)
+	}
+	var fs []Finding
+	if err := json.Unmarshal(buf.Bytes(), &fs); err != nil || len(fs) != 2 {
+		z.Errorf("WriteJSON() = %s, error %v", buf.String(), err)
+	}
+
+	buf.Reset()
+	if err := r.WriteSARIF(&buf); err != nil {
+		z.Fatal(err)
+	}
+	var log struct {
+		Version string
+		Runs    []struct {
+			Results []struct {
+				Level string
+			}
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &log); err != nil {
+		z.Fatal(err)
+	}
+	if log.Version != "2.1.0" || len(log.Runs) != 1 || len(log.Runs[0].Results) != 2 || log.Runs[0].Results[1].Level != "error" {
+		z.Errorf("WriteSARIF() = %s", buf.String())
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package pre
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/goulash/pre/ast"
+)
+
+// Limits that ParseUntrusted applies, unless the Processor sets stricter ones.
+const (
+	UntrustedMaxSize      = 1 << 20 // maximum size of the input in bytes
+	UntrustedMaxSteps     = 1 << 20 // see Processor.MaxSteps
+	UntrustedMaxTokenSize = 1 << 16 // see Processor.MaxTokenSize
+	UntrustedMaxOutput    = 1 << 24 // see Processor.MaxOutputSize
+	UntrustedMaxExpansion = 100     // see Processor.MaxExpansion
+)
+
+var (
+	// ErrInputTooLarge is returned by ParseUntrusted for input that is larger
+	// than UntrustedMaxSize.
+	ErrInputTooLarge = errors.New("input exceeds maximum size")
+
+	// ErrInternal is returned by ParseUntrusted if the parser panicked,
+	// which is a bug in pre.
+	ErrInternal = errors.New("internal error")
+)
+
+// ParseUntrusted parses code like ParseString, but is meant for input that
+// cannot be trusted, such as user uploads. It guarantees that:
+//
+//  - It does not panic.
+//  - It does not access the file system or reveal the names of the host
+//    and of the user, as with SafeMode.
+//  - Input larger than UntrustedMaxSize is rejected without being parsed.
+//  - Parsing stops after UntrustedMaxSteps steps, and no comment may be
+//    larger than UntrustedMaxTokenSize, which bounds time and memory.
+//  - The output is at most UntrustedMaxOutput bytes and UntrustedMaxExpansion
+//    times as large as the input, even if the input uses trusted Symbols
+//    or fragments many times.
+//  - It returns either a tree and a nil error, or a nil tree and an error
+//    of type *ast.Error, whose Err is one of the errors of this package or
+//    of ast, such as ErrInputTooLarge or ast.ErrBudgetExceeded, or an error
+//    describing invalid input.
+//
+// The other settings of p apply as usual. Symbols and Defines are trusted,
+// since they are not part of the input.
+func (p *Processor) ParseUntrusted(name, code string) (nod ast.Node, err error) {
+	fail := func(err error) (ast.Node, error) {
+		if _, ok := err.(*ast.Error); !ok {
+			err = &ast.Error{Err: err, PosInfo: ast.PosInfo{Name: name}}
+		}
+		return nil, err
+	}
+	if len(code) > UntrustedMaxSize {
+		return fail(fmt.Errorf("%w: %d bytes", ErrInputTooLarge, len(code)))
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			nod, err = fail(fmt.Errorf("%w: %v", ErrInternal, r))
+		}
+	}()
+
+	q := *p
+	q.SafeMode = true
+	q.MaxSteps = stricter(p.MaxSteps, UntrustedMaxSteps)
+	q.MaxTokenSize = stricter(p.MaxTokenSize, UntrustedMaxTokenSize)
+	q.MaxOutputSize = stricter(p.MaxOutputSize, UntrustedMaxOutput)
+	q.MaxExpansion = stricter(p.MaxExpansion, UntrustedMaxExpansion)
+	parser := newParser(&q)
+	if err := parser.ParseString(name, code); err != nil {
+		return fail(err)
+	}
+	return parser.Root(), nil
+}
+
+// stricter returns the limit n if it is set and stricter than max,
+// otherwise max.
+func stricter(n, max int) int {
+	if n > 0 && n < max {
+		return n
+	}
+	return max
+}
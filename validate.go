@@ -0,0 +1,33 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package pre
+
+import "github.com/goulash/pre/ast"
+
+// Validate checks the file at path and the files it includes without
+// building the output, which is faster than Process for checks such as
+// pre-commit hooks. The syntax of the directives is checked, and all
+// commands are run, so that missing includes and error commands are
+// found. The diagnostics are returned instead of being passed to
+// Diagnostics, followed by the error that stopped the parse, if any,
+// with the code "error" unless pre defines a more specific one.
+func (p *Processor) Validate(path string) []ast.Diagnostic {
+	parser := newParser(p)
+	parser.Sink = nil
+	parser.Validate = true
+	err := parser.Parse(path)
+	ds := parser.Diagnostics()
+	if err != nil {
+		d := ast.Diagnostic{Code: "error", Message: err.Error()}
+		if e, ok := err.(*ast.Error); ok {
+			d.PosInfo, d.Message = e.PosInfo, errorMessage(e)
+			if code := errorCode(e.Err); code != "" {
+				d.Code = code
+			}
+		}
+		ds = append(ds, d)
+	}
+	return ds
+}
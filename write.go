@@ -0,0 +1,144 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package pre
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ProcessInPlace processes the file at path and replaces it with the result.
+// The file is replaced atomically, and only if the result differs from the
+// original, so that modification times stay stable for build systems.
+// If BackupSuffix is set, the original is first copied to path+BackupSuffix.
+// ProcessInPlace returns true if the file was rewritten.
+func (p *Processor) ProcessInPlace(path string) (bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	orig, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	var buf bytes.Buffer
+	if err := p.Process(&buf, path); err != nil {
+		return false, err
+	}
+	if bytes.Equal(buf.Bytes(), orig) {
+		return false, nil
+	}
+
+	if p.BackupSuffix != "" {
+		err := copyFile(path, path+p.BackupSuffix, fi.Mode().Perm())
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, writeFileAtomic(path, buf.Bytes(), fi.Mode().Perm())
+}
+
+// RenameReferences edits the include and require commands in the files
+// that are reachable from the roots, so that those that refer to the file
+// at from refer to the file at to instead, as with ast.Index.Rename.
+// Nothing else in the files is changed. It returns the paths of the files
+// that were changed, sorted, even if an error occurs. The file at from is
+// not moved; that is left to the caller.
+func (p *Processor) RenameReferences(roots []string, from, to string) ([]string, error) {
+	x, err := p.Index(roots...)
+	if err != nil {
+		return nil, err
+	}
+	edits, err := x.Rename(from, to)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(edits))
+	for path := range edits {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for i, path := range paths {
+		fi, err := os.Stat(path)
+		if err == nil {
+			err = writeFileAtomic(path, edits[path], fi.Mode().Perm())
+		}
+		if err != nil {
+			return paths[:i], err
+		}
+	}
+	return paths, nil
+}
+
+// WriteFileIfChanged writes data to the file at path with permissions perm,
+// unless the file already has exactly this content, so that modification
+// times stay stable for build systems such as make and ninja. The file is
+// replaced atomically. WriteFileIfChanged returns true if it was written.
+func WriteFileIfChanged(path string, data []byte, perm os.FileMode) (bool, error) {
+	orig, err := ioutil.ReadFile(path)
+	if err == nil && bytes.Equal(orig, data) {
+		return false, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, writeFileAtomic(path, data, perm)
+}
+
+// A FileSink is a writer for output, such as that of Process, that is
+// written to a file with WriteFileIfChanged when the sink is closed.
+type FileSink struct {
+	path    string
+	perm    os.FileMode
+	buf     bytes.Buffer
+	changed bool
+}
+
+// NewFileSink returns a FileSink for the file at path, which is created
+// with permissions perm if it does not exist.
+func NewFileSink(path string, perm os.FileMode) *FileSink {
+	return &FileSink{path: path, perm: perm}
+}
+
+func (s *FileSink) Write(bs []byte) (int, error) { return s.buf.Write(bs) }
+
+// Close writes the output to the file, if it differs from what is in it.
+func (s *FileSink) Close() error {
+	var err error
+	s.changed, err = WriteFileIfChanged(s.path, s.buf.Bytes(), s.perm)
+	return err
+}
+
+// Changed returns true if Close wrote the file.
+func (s *FileSink) Changed() bool { return s.changed }
+
+// writeFileAtomic writes data to a temporary file next to path and then
+// renames it to path, so that readers never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir, name := filepath.Split(path)
+	f, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
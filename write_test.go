@@ -0,0 +1,623 @@
+// Copyright (c) 2015, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package pre
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/goulash/pre/ast"
+)
+
+func TestProcessInPlace(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const (
+		orig = "// This comment is stripped.\nText\n"
+		exp  = "\nText\n"
+	)
+	path := filepath.Join(dir, "file.txt")
+	if err := ioutil.WriteFile(path, []byte(orig), 0640); err != nil {
+		z.Fatal(err)
+	}
+
+	p := New()
+	p.AddCommenter(CppComment, true)
+	p.BackupSuffix = ".bak"
+	for i, want := range []bool{true, false} {
+		ok, err := p.ProcessInPlace(path)
+		if err != nil {
+			z.Fatal(err)
+		}
+		if ok != want {
+			z.Errorf("ProcessInPlace #%d = %v, want %v", i, ok, want)
+		}
+	}
+
+	for name, want := range map[string]string{"file.txt": exp, "file.txt.bak": orig} {
+		bs, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			z.Error(err)
+			continue
+		}
+		if string(bs) != want {
+			z.Errorf("%s = %q, want %q", name, bs, want)
+		}
+	}
+}
+
+func TestFingerprint(z *testing.T) {
+	p := New()
+	p.AddCommenter(CppComment, true)
+
+	a, err := p.Fingerprint("testdata/parent.test")
+	if err != nil {
+		z.Fatal(err)
+	}
+	b, err := p.Fingerprint("testdata/parent.result")
+	if err != nil {
+		z.Fatal(err)
+	}
+	if a != b {
+		z.Errorf("Fingerprint of test and result differ: %s != %s", a, b)
+	}
+
+	a, err = p.ClosureFingerprint("testdata/parent.test")
+	if err != nil {
+		z.Fatal(err)
+	}
+	b, err = p.ClosureFingerprint("testdata/parent.result")
+	if err != nil {
+		z.Fatal(err)
+	}
+	if a == b {
+		z.Errorf("ClosureFingerprint of test and result should differ: %s", a)
+	}
+}
+
+func TestCacheDir(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root.txt")
+	dep := filepath.Join(dir, "dep.txt")
+	write := func(path, s string) {
+		if err := ioutil.WriteFile(path, []byte(s), 0644); err != nil {
+			z.Fatal(err)
+		}
+	}
+	write(root, "A\n#include \"dep.txt\"\n")
+	write(dep, "B\n")
+
+	p := New()
+	p.CacheDir = filepath.Join(dir, "cache")
+	for i, want := range []string{"A\nB\n", "A\nB\n", "A\nC\n"} {
+		if i == 2 {
+			write(dep, "C\n")
+		}
+		var buf bytes.Buffer
+		if err := p.Process(&buf, root); err != nil {
+			z.Fatal(err)
+		}
+		if buf.String() != want {
+			z.Errorf("Process #%d = %q, want %q", i, buf.String(), want)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(p.CacheDir)
+	if err != nil {
+		z.Fatal(err)
+	}
+	if len(entries) != 2 {
+		z.Errorf("cache has %d files, want 2", len(entries))
+	}
+}
+
+func TestCacheDirLookups(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(path, s string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte(s), 0644); err != nil {
+			z.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+		z.Fatal(err)
+	}
+	write("root.txt", "#include \"site.txt\" or \"defaults.txt\"\n#include? \"local.txt\"\n#include \"d\"\n")
+	write("defaults.txt", "A\n")
+	write("d/1.txt", "B\n")
+
+	p := New()
+	p.IncludeDirs = true
+	p.CacheDir = filepath.Join(dir, "cache")
+	for i, t := range []struct {
+		Path, Content string
+		Want          string
+	}{
+		{"", "", "A\nB\n"},
+		{"site.txt", "C\n", "C\nB\n"},
+		{"local.txt", "D\n", "C\nD\nB\n"},
+		{"d/2.txt", "E\n", "C\nD\nB\nE\n"},
+	} {
+		if t.Path != "" {
+			write(t.Path, t.Content)
+		}
+		var buf bytes.Buffer
+		if err := p.Process(&buf, filepath.Join(dir, "root.txt")); err != nil {
+			z.Fatal(err)
+		}
+		if buf.String() != t.Want {
+			z.Errorf("Process #%d = %q, want %q", i, buf.String(), t.Want)
+		}
+	}
+}
+
+func TestFilters(z *testing.T) {
+	p := New()
+	p.Filters = []Filter{
+		func(bs []byte) ([]byte, error) { return bytes.ToUpper(bs), nil },
+		func(bs []byte) ([]byte, error) { return bytes.TrimSpace(bs), nil },
+	}
+	var buf bytes.Buffer
+	if err := p.Process(&buf, "testdata/child.test"); err != nil {
+		z.Fatal(err)
+	}
+	const exp = "THIS IS THE CHILD TEXT, INCLUDED BY THE PARENT FILE.\nEOF"
+	if got := buf.String(); got != exp {
+		z.Errorf("got %q, want %q", got, exp)
+	}
+
+	failed := errors.New("failed")
+	p.Filters = append(p.Filters, func([]byte) ([]byte, error) { return nil, failed })
+	buf.Reset()
+	if err := p.Process(&buf, "testdata/child.test"); err != failed {
+		z.Errorf("Process() error = %v, want %v", err, failed)
+	}
+	if buf.Len() != 0 {
+		z.Errorf("Process() wrote %q despite error", buf.String())
+	}
+}
+
+func TestBundle(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"site/pages/index.html":   "#include \"../partials/head.html\"\nIndex\n",
+		"site/partials/head.html": "#require \"../../shared/meta.html\"\nHead\n",
+		"shared/meta.html":        "Meta\n",
+		"site/unused.html":        "Unused\n",
+	}
+	for name, s := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			z.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(s), 0644); err != nil {
+			z.Fatal(err)
+		}
+	}
+
+	p := New()
+	var exp bytes.Buffer
+	if err := p.Process(&exp, filepath.Join(dir, "site/pages/index.html")); err != nil {
+		z.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	name, err := p.Bundle(&buf, filepath.Join(dir, "site/pages/index.html"))
+	if err != nil {
+		z.Fatal(err)
+	}
+	if name != "site/pages/index.html" {
+		z.Errorf("Bundle() = %q, want site/pages/index.html", name)
+	}
+	bundle := filepath.Join(dir, "bundle.zip")
+	if err := ioutil.WriteFile(bundle, buf.Bytes(), 0644); err != nil {
+		z.Fatal(err)
+	}
+	for _, name := range []string{"site", "shared"} {
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			z.Fatal(err)
+		}
+	}
+
+	var got bytes.Buffer
+	if err := p.Process(&got, bundle+"!/"+name); err != nil {
+		z.Fatal(err)
+	}
+	if got.String() != exp.String() {
+		z.Errorf("Process(bundle) = %q, want %q", got.String(), exp.String())
+	}
+}
+
+func TestBundleFS(z *testing.T) {
+	p := New()
+	p.FS = ast.MapFS{
+		"/site/index.html":  "#include \"../shared/meta.html\"\nIndex\n",
+		"/shared/meta.html": "Meta\n",
+	}
+	var buf bytes.Buffer
+	name, err := p.Bundle(&buf, "/site/index.html")
+	if err != nil {
+		z.Fatal(err)
+	}
+	if name != "site/index.html" {
+		z.Errorf("Bundle() = %q, want site/index.html", name)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		z.Fatal(err)
+	}
+	if len(zr.File) != 2 || zr.File[1].Name != "shared/meta.html" {
+		z.Errorf("Bundle() wrote %d files, want site/index.html and shared/meta.html", len(zr.File))
+	}
+
+	// Includes are not rewritten, so files found by other than their
+	// relative paths are not found in the archive.
+	for _, code := range []string{
+		"#include \"/shared/meta.html\"\n",
+		"#include \"meta\"\n",
+		"#include <meta.html>\n",
+	} {
+		p.FS.(ast.MapFS)["/site/index.html"] = code
+		p.IncludeMap = map[string]string{"meta": "/shared/meta.html"}
+		p.IncludePaths = []string{"/shared"}
+		if _, err := p.Bundle(&buf, "/site/index.html"); err == nil {
+			z.Errorf("Bundle() of %q did not fail", code)
+		}
+	}
+
+	if _, err := commonDir([]string{"a/b.txt", "/c.txt"}); err == nil {
+		z.Errorf("commonDir() of relative and absolute paths did not fail")
+	}
+}
+
+func TestFlatten(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"main.c":     "// Main\n#include \"inc/util.h\"\n#pragma once\nint main;\n",
+		"inc/util.h": "/* Util */\n#require \"../types.h\"\nint util;\n",
+		"types.h":    "int types;\n",
+	}
+	for name, s := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			z.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(s), 0644); err != nil {
+			z.Fatal(err)
+		}
+	}
+
+	p := New()
+	p.AddCommenter(&ast.Commenter{Begin: "//"}, true)
+	p.AddCommenter(&ast.Commenter{Begin: "/*", End: "*/"}, true)
+	const exp = "// Main\n" +
+		"// begin include inc/util.h\n" +
+		"/* Util */\n" +
+		"// begin include types.h\n" +
+		"int types;\n" +
+		"// end include types.h\n" +
+		"int util;\n" +
+		"// end include inc/util.h\n" +
+		"#pragma once\n" +
+		"int main;\n"
+	var buf bytes.Buffer
+	if err := p.Flatten(&buf, filepath.Join(dir, "main.c"), true); err != nil {
+		z.Fatal(err)
+	}
+	if got := buf.String(); got != exp {
+		z.Errorf("Flatten() = %q, want %q", got, exp)
+	}
+
+	// Nothing else is transformed.
+	path := filepath.Join(dir, "other.txt")
+	src := "#pragma strip-comments on\n// note\nA __FILE__ __LINE__ __GOOS__"
+	if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+		z.Fatal(err)
+	}
+	p.Builtins = true
+	p.PlatformBuiltins = true
+	p.FinalNewline = true
+	buf.Reset()
+	if err := p.Flatten(&buf, path, false); err != nil {
+		z.Fatal(err)
+	}
+	if got := buf.String(); got != src {
+		z.Errorf("Flatten() = %q, want %q", got, src)
+	}
+}
+
+func TestFinalNewline(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.txt")
+	p := New()
+	p.FinalNewline = true
+	for code, exp := range map[string]string{"A": "A\n", "A\n": "A\n", "": ""} {
+		if err := ioutil.WriteFile(path, []byte(code), 0644); err != nil {
+			z.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := p.Process(&buf, path); err != nil {
+			z.Fatal(err)
+		}
+		if s := buf.String(); s != exp {
+			z.Errorf("Process() of %q = %q, want %q", code, s, exp)
+		}
+	}
+}
+
+func TestBanner(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.txt")
+	if err := ioutil.WriteFile(path, []byte("A\n"), 0644); err != nil {
+		z.Fatal(err)
+	}
+
+	p := New()
+	p.Banner = DefaultBanner
+	var buf bytes.Buffer
+	if err := p.Process(&buf, path); err == nil {
+		z.Errorf("Process() without commenters did not fail")
+	}
+	p.AddCommenter(CComment, false)
+	buf.Reset()
+	if err := p.Process(&buf, path); err != nil {
+		z.Fatal(err)
+	}
+	exp := fmt.Sprintf("/* generated by pre from %s (sha256 %x); do not edit */\nA\n",
+		path, sha256.Sum256([]byte("A\n")))
+	if s := buf.String(); s != exp {
+		z.Errorf("Process() = %q, want %q", s, exp)
+	}
+
+	// The banner follows a shebang line.
+	script := filepath.Join(dir, "run.sh")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho A\n"), 0644); err != nil {
+		z.Fatal(err)
+	}
+	p.Trigger = "@"
+	p.Banner = "{source}"
+	buf.Reset()
+	if err := p.Process(&buf, script); err != nil {
+		z.Fatal(err)
+	}
+	exp = fmt.Sprintf("#!/bin/sh\n/* %s */\necho A\n", script)
+	if s := buf.String(); s != exp {
+		z.Errorf("Process() = %q, want %q", s, exp)
+	}
+
+	// The source is named as in positions.
+	p.NameBase = filepath.Dir(dir)
+	p.SlashNames = true
+	buf.Reset()
+	if err := p.Process(&buf, script); err != nil {
+		z.Fatal(err)
+	}
+	exp = fmt.Sprintf("#!/bin/sh\n/* %s/run.sh */\necho A\n", filepath.Base(dir))
+	if s := buf.String(); s != exp {
+		z.Errorf("Process() = %q, want %q", s, exp)
+	}
+}
+
+func TestFileSink(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.txt")
+
+	for i, t := range []struct {
+		Data    string
+		Changed bool
+	}{{"A\n", true}, {"A\n", false}, {"B\n", true}} {
+		s := NewFileSink(path, 0644)
+		if _, err := s.Write([]byte(t.Data)); err != nil {
+			z.Fatal(err)
+		}
+		if err := s.Close(); err != nil {
+			z.Fatal(err)
+		}
+		if s.Changed() != t.Changed {
+			z.Errorf("write %d: Changed() = %v, want %v", i, s.Changed(), t.Changed)
+		}
+		if bs, _ := ioutil.ReadFile(path); string(bs) != t.Data {
+			z.Errorf("write %d: file = %q, want %q", i, bs, t.Data)
+		}
+	}
+}
+
+func TestParseOptions(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.txt")
+	if err := ioutil.WriteFile(path, []byte("// note\nA\n"), 0644); err != nil {
+		z.Fatal(err)
+	}
+
+	p := New()
+	p.AddCommenter(CppComment, true)
+	var tests = []struct {
+		Opts []ParseOption
+		Exp  string
+	}{
+		{nil, "\nA\n"},
+		{[]ParseOption{KeepComments()}, "// note\nA\n"},
+		{[]ParseOption{KeepComments(), StripComments()}, "\nA\n"},
+	}
+	errs := make(chan error, len(tests))
+	for _, t := range tests {
+		go func(opts []ParseOption, exp string) {
+			var buf bytes.Buffer
+			if err := p.Process(&buf, path, opts...); err != nil {
+				errs <- err
+			} else if s := buf.String(); s != exp {
+				errs <- fmt.Errorf("Process() = %q, want %q", s, exp)
+			} else {
+				errs <- nil
+			}
+		}(t.Opts, t.Exp)
+	}
+	for range tests {
+		if err := <-errs; err != nil {
+			z.Error(err)
+		}
+	}
+	if !p.Commenters[0].Strip {
+		z.Errorf("options changed the Processor")
+	}
+
+	strip := CppComment.Strip
+	for _, opt := range []ParseOption{KeepComments(), StripComments()} {
+		var buf bytes.Buffer
+		if err := New(WithCommenters(CppComment)).Process(&buf, path, opt); err != nil {
+			z.Fatal(err)
+		}
+		if CppComment.Strip != strip {
+			z.Errorf("options changed CppComment")
+		}
+	}
+}
+
+func TestOptions(z *testing.T) {
+	fs := ast.MapFS{
+		"/a.txt": "%include \"/b.txt\"\nA\n",
+		"/b.txt": "B\n",
+		"/c.txt": "@include \"/b.txt\"\n",
+	}
+	p := New(WithOptions(ast.Options{Trigger: "%", FS: fs}), WithMaxIncludeDepth(4))
+	if p.Trigger != "%" || p.MaxIncludeDepth != 4 || p.FS == nil {
+		z.Fatalf("New() = %+v", p)
+	}
+	var buf bytes.Buffer
+	if err := p.Process(&buf, "/a.txt"); err != nil {
+		z.Fatal(err)
+	} else if s := buf.String(); s != "B\nA\n" {
+		z.Errorf("Process() = %q, want %q", s, "B\nA\n")
+	}
+	buf.Reset()
+	q := p.Clone()
+	q.Apply(WithTrigger("@"))
+	if err := q.Process(&buf, "/c.txt"); err != nil {
+		z.Fatal(err)
+	} else if s := buf.String(); s != "B\n" {
+		z.Errorf("Process() = %q, want %q", s, "B\n")
+	}
+	if p.Trigger != "%" {
+		z.Errorf("Apply changed the original of the clone")
+	}
+
+	ap := ast.NewParser(ast.WithOptions(ast.Options{MaxIncludeDepth: 8}), ast.WithFS(fs))
+	if ap.Trigger != "#" || ap.MaxIncludeDepth != 8 || ap.FS == nil {
+		z.Errorf("NewParser() = %+v", ap)
+	}
+}
+
+func TestRenameReferences(z *testing.T) {
+	dir, err := ioutil.TempDir("", "pre")
+	if err != nil {
+		z.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		z.Fatal(err)
+	}
+	files := map[string]string{
+		"root.txt":    "A\n#include \"parts/a.txt\"\n#include \"sub/b.txt\"\n",
+		"sub/b.txt":   "#require \"../parts/a.txt\" or \"other.txt\"\n\"parts/a.txt\"\n",
+		"parts/a.txt": "a\n",
+	}
+	for name, s := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			z.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(s), 0644); err != nil {
+			z.Fatal(err)
+		}
+	}
+
+	p := New()
+	changed, err := p.RenameReferences([]string{filepath.Join(dir, "root.txt")},
+		filepath.Join(dir, "parts", "a.txt"), filepath.Join(dir, "lib", "a.txt"))
+	if err != nil {
+		z.Fatal(err)
+	}
+	exp := []string{filepath.Join(dir, "root.txt"), filepath.Join(dir, "sub", "b.txt")}
+	if !reflect.DeepEqual(changed, exp) {
+		z.Errorf("RenameReferences() = %q, want %q", changed, exp)
+	}
+	for name, want := range map[string]string{
+		"root.txt":  "A\n#include \"lib/a.txt\"\n#include \"sub/b.txt\"\n",
+		"sub/b.txt": "#require \"../lib/a.txt\" or \"other.txt\"\n\"parts/a.txt\"\n",
+	} {
+		bs, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			z.Fatal(err)
+		}
+		if string(bs) != want {
+			z.Errorf("%s = %q, want %q", name, bs, want)
+		}
+	}
+}
+
+func TestMmap(z *testing.T) {
+	p := New()
+	p.AddCommenter(CppComment, true)
+	var exp bytes.Buffer
+	if err := p.Process(&exp, "testdata/parent.test"); err != nil {
+		z.Fatal(err)
+	}
+
+	p.Mmap = true
+	var got bytes.Buffer
+	if err := p.Process(&got, "testdata/parent.test"); err != nil {
+		z.Fatal(err)
+	}
+	if got.String() != exp.String() {
+		z.Errorf("Process with Mmap = %q, want %q", got.String(), exp.String())
+	}
+}